@@ -1,6 +1,11 @@
 package main
 
 import (
+	"html"
+	"strconv"
+
+	"cogentcore.org/core/base/fileinfo/mimedata"
+	"cogentcore.org/core/colors"
 	"cogentcore.org/core/core"
 	"cogentcore.org/core/events"
 	"cogentcore.org/core/icons"
@@ -60,6 +65,105 @@ func (gr *Graph) MakeToolbar(p *tree.Plan) {
 	})
 }
 
+// MakeSliders makes a slider for each slider variable. The widgets look up their variable by name
+// whenever they are used, since the variables can be replaced by ones with the same name.
+func (gr *Graph) MakeSliders(p *tree.Plan) {
+	for _, v := range gr.Variables {
+		if !v.IsSlider() {
+			continue
+		}
+		name := v.Name
+		tree.AddAt(p, name+"-label", func(w *core.Text) {
+			w.Updater(func() {
+				if v := gr.Variables.Find(name); v != nil {
+					w.SetText(v.Name + " = " + v.Expr.Expr)
+				}
+			})
+		})
+		tree.AddAt(p, name, func(w *core.Slider) {
+			w.Updater(func() {
+				v := gr.Variables.Find(name)
+				if v == nil {
+					return
+				}
+				step := v.Step
+				if step == 0 {
+					step = (v.Max - v.Min) / 100
+				}
+				w.SetMin(float32(v.Min)).SetMax(float32(v.Max)).SetStep(float32(step))
+				w.SetValue(float32(v.Value()))
+			})
+			w.OnInput(func(e events.Event) {
+				v := gr.Variables.Find(name)
+				if v == nil {
+					return
+				}
+				v.SetValue(float64(w.Value))
+				gr.UpdateVariable(v)
+				gr.Objects.SlidersFrame.Update()
+			})
+		})
+	}
+}
+
+// MakeDiagnostics makes a text for each problem with the expressions of the graph.
+// The texts look up their problem by index whenever they are updated, since the problems change.
+func (gr *Graph) MakeDiagnostics(p *tree.Plan) {
+	for i := range gr.Diagnostics() {
+		tree.AddAt(p, strconv.Itoa(i), func(w *core.Text) {
+			w.Styler(func(s *styles.Style) {
+				s.Color = colors.Scheme.Error.Base
+			})
+			w.Updater(func() {
+				ds := gr.Diagnostics()
+				if i >= len(ds) {
+					return
+				}
+				d := ds[i]
+				w.SetText("<b>" + html.EscapeString(d.Where()) + "</b>: " + html.EscapeString(d.Msg))
+			})
+		})
+	}
+}
+
+// MakePreviews makes a typeset preview of each line, with a button to copy it as LaTeX.
+// The widgets look up their line by index whenever they are used, since the lines can change.
+func (gr *Graph) MakePreviews(p *tree.Plan) {
+	line := func(i int) *Line {
+		if i < len(gr.Lines) {
+			return gr.Lines[i]
+		}
+		return nil
+	}
+	for i, ln := range gr.Lines {
+		if ln.Expr.Expr == "" {
+			continue
+		}
+		tree.AddAt(p, strconv.Itoa(i), func(w *core.Frame) {
+			w.Styler(func(s *styles.Style) {
+				s.Direction = styles.Row
+			})
+			w.Maker(func(p *tree.Plan) {
+				tree.Add(p, func(w *core.Button) {
+					w.SetIcon(icons.ContentCopy).SetTooltip("Copy as LaTeX")
+					w.OnClick(func(e events.Event) {
+						if ln := line(i); ln != nil {
+							w.Clipboard().Write(mimedata.NewText(ln.LaTeX()))
+						}
+					})
+				})
+				tree.Add(p, func(w *core.Text) {
+					w.Updater(func() {
+						if ln := line(i); ln != nil {
+							w.SetText(ln.Preview())
+						}
+					})
+				})
+			})
+		})
+	}
+}
+
 func (gr *Graph) MakeBasicElements(b *core.Body) {
 	sp := core.NewSplits(b).SetTiles(core.TileSecondLong)
 	sp.Styler(func(s *styles.Style) {
@@ -70,16 +174,49 @@ func (gr *Graph) MakeBasicElements(b *core.Body) {
 		}
 	})
 
-	gr.Objects.LinesTable = core.NewTable(sp).SetSlice(&gr.Lines)
+	lfr := core.NewFrame(sp)
+	lfr.Styler(func(s *styles.Style) {
+		s.Direction = styles.Column
+	})
+
+	gr.Objects.LinesTable = core.NewTable(lfr).SetSlice(&gr.Lines)
 	gr.Objects.LinesTable.OnChange(func(e events.Event) {
 		gr.Graph()
 	})
 
-	gr.Objects.ParamsForm = core.NewForm(sp).SetStruct(&gr.Params)
+	gr.Objects.PreviewsFrame = core.NewFrame(lfr)
+	gr.Objects.PreviewsFrame.Styler(func(s *styles.Style) {
+		s.Direction = styles.Column
+	})
+	gr.Objects.PreviewsFrame.Maker(gr.MakePreviews)
+
+	gr.Objects.HelpersTable = core.NewTable(lfr).SetSlice(&gr.Helpers)
+	gr.Objects.HelpersTable.OnChange(func(e events.Event) {
+		gr.Graph()
+	})
+
+	pfr := core.NewFrame(sp)
+	pfr.Styler(func(s *styles.Style) {
+		s.Direction = styles.Column
+	})
+
+	gr.Objects.ParamsForm = core.NewForm(pfr).SetStruct(&gr.Params)
 	gr.Objects.ParamsForm.OnChange(func(e events.Event) {
 		gr.Graph()
 	})
 
+	gr.Objects.VariablesTable = core.NewTable(pfr).SetSlice(&gr.Variables)
+	gr.Objects.VariablesTable.OnChange(func(e events.Event) {
+		gr.Graph()
+		gr.Objects.SlidersFrame.Update()
+	})
+
+	gr.Objects.SlidersFrame = core.NewFrame(pfr)
+	gr.Objects.SlidersFrame.Styler(func(s *styles.Style) {
+		s.Direction = styles.Column
+	})
+	gr.Objects.SlidersFrame.Maker(gr.MakeSliders)
+
 	gr.Objects.Graph = core.NewCanvas(sp).SetDraw(gr.draw)
 
 	gr.Vectors.Min = math32.Vector2{X: -GraphViewBoxSize, Y: -GraphViewBoxSize}
@@ -88,6 +225,12 @@ func (gr *Graph) MakeBasicElements(b *core.Body) {
 	var n float32 = 1.0 / float32(TheSettings.GraphInc)
 	gr.Vectors.Inc = math32.Vector2{X: n, Y: n}
 
+	gr.Objects.DiagnosticsFrame = core.NewFrame(b)
+	gr.Objects.DiagnosticsFrame.Styler(func(s *styles.Style) {
+		s.Direction = styles.Column
+	})
+	gr.Objects.DiagnosticsFrame.Maker(gr.MakeDiagnostics)
+
 	statusText := core.NewText(b)
 	statusText.Updater(func() {
 		if gr.State.File == "" {
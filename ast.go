@@ -0,0 +1,258 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Node is a node in the syntax tree of an expression
+type Node interface {
+	// Pos returns the rune offset of the start of the node in the source expression
+	Pos() int
+
+	// End returns the rune offset just after the end of the node in the source expression
+	End() int
+
+	// String returns the node as fully parenthesized text
+	String() string
+}
+
+// NumberNode is a number literal
+type NumberNode struct {
+	Val  float64
+	Text string
+
+	NodePos, NodeEnd int
+}
+
+// BoolNode is a true or false literal
+type BoolNode struct {
+	Val bool
+
+	NodePos, NodeEnd int
+}
+
+// VarNode is a reference to a variable, like x or π
+type VarNode struct {
+	Name string
+
+	NodePos, NodeEnd int
+}
+
+// UnaryNode is a unary operation, either - or !
+type UnaryNode struct {
+	Op    string
+	X     Node
+	OpPos int
+}
+
+// BinaryNode is a binary operation, like + or &&. Implicit multiplication is a * node.
+type BinaryNode struct {
+	Op   string
+	X, Y Node
+}
+
+// ParenNode is an expression in parentheses
+type ParenNode struct {
+	X Node
+
+	NodePos, NodeEnd int
+}
+
+// CallNode is a function call, like sin(x), sinx, or rand
+type CallNode struct {
+	Name string
+	Args []Node
+
+	// Paren is whether the arguments were given in parentheses
+	Paren bool
+
+	NodePos, NodeEnd int
+}
+
+// PointNode is a point or vector with two components, like (3, 4)
+type PointNode struct {
+	X, Y Node
+
+	NodePos, NodeEnd int
+}
+
+// MemberNode is the x or y component of a point, like p.x
+type MemberNode struct {
+	X     Node
+	Field string
+
+	NodeEnd int
+}
+
+// FuncNode is a reference to a function by name, like the f in root(f, 0, 1)
+type FuncNode struct {
+	Name string
+
+	NodePos, NodeEnd int
+}
+
+// PiecewiseNode is a piecewise expression, like {x<0: x^2, x<3: 2x, 5}.
+// Its value is the value of the first case whose condition is true, or Else if
+// none of them are. If Else is nil, the expression is undefined there.
+type PiecewiseNode struct {
+	Conds []Node
+	Vals  []Node
+	Else  Node
+
+	NodePos, NodeEnd int
+}
+
+func (n *NumberNode) Pos() int { return n.NodePos }
+func (n *NumberNode) End() int { return n.NodeEnd }
+func (n *BoolNode) Pos() int   { return n.NodePos }
+func (n *BoolNode) End() int   { return n.NodeEnd }
+func (n *VarNode) Pos() int    { return n.NodePos }
+func (n *VarNode) End() int    { return n.NodeEnd }
+func (n *UnaryNode) Pos() int  { return n.OpPos }
+func (n *UnaryNode) End() int  { return n.X.End() }
+func (n *BinaryNode) Pos() int { return n.X.Pos() }
+func (n *BinaryNode) End() int { return n.Y.End() }
+func (n *ParenNode) Pos() int  { return n.NodePos }
+func (n *ParenNode) End() int  { return n.NodeEnd }
+func (n *CallNode) Pos() int   { return n.NodePos }
+func (n *CallNode) End() int   { return n.NodeEnd }
+
+func (n *PointNode) Pos() int     { return n.NodePos }
+func (n *PointNode) End() int     { return n.NodeEnd }
+func (n *MemberNode) Pos() int    { return n.X.Pos() }
+func (n *MemberNode) End() int    { return n.NodeEnd }
+func (n *FuncNode) Pos() int      { return n.NodePos }
+func (n *FuncNode) End() int      { return n.NodeEnd }
+func (n *PiecewiseNode) Pos() int { return n.NodePos }
+func (n *PiecewiseNode) End() int { return n.NodeEnd }
+
+func (n *NumberNode) String() string {
+	return strconv.FormatFloat(n.Val, 'f', -1, 64)
+}
+
+func (n *BoolNode) String() string {
+	return strconv.FormatBool(n.Val)
+}
+
+func (n *VarNode) String() string {
+	return n.Name
+}
+
+func (n *UnaryNode) String() string {
+	return "(" + n.Op + n.X.String() + ")"
+}
+
+func (n *BinaryNode) String() string {
+	return "(" + n.X.String() + " " + n.Op + " " + n.Y.String() + ")"
+}
+
+func (n *ParenNode) String() string {
+	return n.X.String()
+}
+
+func (n *CallNode) String() string {
+	args := make([]string, len(n.Args))
+	for i, a := range n.Args {
+		args[i] = a.String()
+	}
+	return n.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (n *PointNode) String() string {
+	return "(" + n.X.String() + ", " + n.Y.String() + ")"
+}
+
+func (n *MemberNode) String() string {
+	return n.X.String() + "." + n.Field
+}
+
+func (n *FuncNode) String() string {
+	return n.Name
+}
+
+func (n *PiecewiseNode) String() string {
+	cases := []string{}
+	for i, c := range n.Conds {
+		cases = append(cases, c.String()+": "+n.Vals[i].String())
+	}
+	if n.Else != nil {
+		cases = append(cases, n.Else.String())
+	}
+	return "{" + strings.Join(cases, ", ") + "}"
+}
+
+// Walk calls f for the node and all of its descendants, depth first.
+// If f returns false, the children of that node are skipped.
+func Walk(n Node, f func(n Node) bool) {
+	if !f(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *UnaryNode:
+		Walk(n.X, f)
+	case *BinaryNode:
+		Walk(n.X, f)
+		Walk(n.Y, f)
+	case *ParenNode:
+		Walk(n.X, f)
+	case *CallNode:
+		for _, a := range n.Args {
+			Walk(a, f)
+		}
+	case *NumDerivNode:
+		Walk(n.X, f)
+	case *PointNode:
+		Walk(n.X, f)
+		Walk(n.Y, f)
+	case *MemberNode:
+		Walk(n.X, f)
+	case *PiecewiseNode:
+		for i, c := range n.Conds {
+			Walk(c, f)
+			Walk(n.Vals[i], f)
+		}
+		if n.Else != nil {
+			Walk(n.Else, f)
+		}
+	}
+}
+
+// Substitute returns a copy of the syntax tree with the variables in vars replaced by their nodes
+func Substitute(n Node, vars map[string]Node) Node {
+	switch n := n.(type) {
+	case *VarNode:
+		if r, ok := vars[n.Name]; ok {
+			return &ParenNode{X: r, NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+		}
+	case *UnaryNode:
+		return &UnaryNode{Op: n.Op, X: Substitute(n.X, vars), OpPos: n.OpPos}
+	case *BinaryNode:
+		return &BinaryNode{Op: n.Op, X: Substitute(n.X, vars), Y: Substitute(n.Y, vars)}
+	case *ParenNode:
+		return &ParenNode{X: Substitute(n.X, vars), NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+	case *CallNode:
+		args := make([]Node, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = Substitute(a, vars)
+		}
+		return &CallNode{Name: n.Name, Args: args, Paren: n.Paren, NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+	case *NumDerivNode:
+		return &NumDerivNode{X: Substitute(n.X, vars), Var: n.Var}
+	case *PointNode:
+		return &PointNode{X: Substitute(n.X, vars), Y: Substitute(n.Y, vars), NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+	case *MemberNode:
+		return &MemberNode{X: Substitute(n.X, vars), Field: n.Field, NodeEnd: n.NodeEnd}
+	case *PiecewiseNode:
+		pw := &PiecewiseNode{NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+		for i, c := range n.Conds {
+			pw.Conds = append(pw.Conds, Substitute(c, vars))
+			pw.Vals = append(pw.Vals, Substitute(n.Vals[i], vars))
+		}
+		if n.Else != nil {
+			pw.Else = Substitute(n.Else, vars)
+		}
+		return pw
+	}
+	return n
+}
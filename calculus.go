@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// opVar returns the name of the variable that the given argument of d or int is
+func opVar(n Node) (string, bool) {
+	for {
+		p, ok := n.(*ParenNode)
+		if !ok {
+			break
+		}
+		n = p.X
+	}
+	vn, ok := n.(*VarNode)
+	if !ok {
+		return "", false
+	}
+	return vn.Name, true
+}
+
+// compileD compiles d(expr, v), the derivative of expr with respect to the variable v,
+// which is differentiated symbolically by [Derivative] when it can be
+func compileD(n *CallNode, cx *Context) (*Compiled, error) {
+	if len(n.Args) != 2 {
+		return nil, compileError(n, "function d needs 2 arguments, like d(sin(x), x), not %v arguments", len(n.Args))
+	}
+	v, ok := opVar(n.Args[1])
+	if !ok {
+		return nil, compileError(n.Args[1], "the second argument of d needs to be a variable, like x or t")
+	}
+	if EnvSlot(v, cx) == nil && cx.Variables.Find(v) == nil {
+		return nil, compileError(n.Args[1], "can not take the derivative with respect to %q", v)
+	}
+	return CompileNode(Derivative(n.Args[0], v, cx), cx)
+}
+
+// compileInt compiles int(expr, v, a, b), the integral of expr from v = a to v = b
+func compileInt(n *CallNode, cx *Context) (*Compiled, error) {
+	if len(n.Args) != 4 {
+		return nil, compileError(n, "function int needs 4 arguments, like int(x^2, x, 0, 1), not %v arguments", len(n.Args))
+	}
+	v, ok := opVar(n.Args[1])
+	if !ok {
+		return nil, compileError(n.Args[1], "the second argument of int needs to be a variable, like x or t")
+	}
+	slot := EnvSlot(v, cx)
+	if slot == nil {
+		return nil, compileError(n.Args[1], "can not integrate with respect to %q", v)
+	}
+	cs := make([]*Compiled, 0, 3)
+	for _, a := range []Node{n.Args[0], n.Args[2], n.Args[3]} {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind != KindNumber {
+			return nil, compileError(a, "function int needs float64 values, not a %v value", c.Kind)
+		}
+		cs = append(cs, c)
+	}
+	f, lo, hi := cs[0].Num, cs[1].Num, cs[2].Num
+	return &Compiled{Kind: KindNumber, Const: cs[0].Const && cs[1].Const && cs[2].Const, Num: func(env *Env) float64 {
+		min, max := lo(env), hi(env)
+		e := env.Clone()
+		s := slot(e)
+		return IntegrateFunc(func(v float64) float64 {
+			*s = v
+			return f(e)
+		}, min, max)
+	}}, nil
+}
+
+// intDerivative returns the derivative of int(expr, iv, a, b) with respect to v,
+// using the Leibniz integral rule
+func intDerivative(n *CallNode, iv, v string, cx *Context) Node {
+	e, a, b := n.Args[0], n.Args[2], n.Args[3]
+	res := sub(mul(Substitute(e, map[string]Node{iv: b}), Derivative(b, v, cx)),
+		mul(Substitute(e, map[string]Node{iv: a}), Derivative(a, v, cx)))
+	if iv == v { // the variable of integration is bound inside the integral
+		return res
+	}
+	if de := Derivative(e, v, cx); !isNum(de, 0) {
+		res = add(res, call("int", de, &VarNode{Name: iv}, a, b))
+	}
+	return res
+}
+
+// MaxTerms is the maximum number of terms of a sum or prod, above which it is NaN
+const MaxTerms = 1_000_000
+
+// compileSum compiles sum(i, lo, hi, expr) and prod(i, lo, hi, expr), which add or multiply
+// expr for i from lo to hi in steps of 1. The index i is a new local variable that can only be used in expr.
+func compileSum(n *CallNode, cx *Context) (*Compiled, error) {
+	if len(n.Args) != 4 {
+		return nil, compileError(n, "function %v needs 4 arguments, like %v(i, 1, 10, i^2), not %v arguments", n.Name, n.Name, len(n.Args))
+	}
+	iv, ok := opVar(n.Args[0])
+	if !ok {
+		return nil, compileError(n.Args[0], "the first argument of %v needs to be the name of the index, like i", n.Name)
+	}
+	cs := make([]*Compiled, 0, 3)
+	for _, a := range n.Args[1:3] {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind != KindNumber {
+			return nil, compileError(a, "the bounds of %v need to be float64 values, not %v values", n.Name, c.Kind)
+		}
+		cs = append(cs, c)
+	}
+	icx := cx.WithLocal(iv)
+	body, err := CompileNode(n.Args[3], icx)
+	if err != nil {
+		return nil, err
+	}
+	if body.Kind != KindNumber {
+		return nil, compileError(n.Args[3], "function %v needs a float64 value, not a %v value", n.Name, body.Kind)
+	}
+	slot := len(cx.Locals)
+	lo, hi, f := cs[0].Num, cs[1].Num, body.Num
+	isProd := n.Name == "prod"
+	return &Compiled{Kind: KindNumber, Const: cs[0].Const && cs[1].Const && body.Const, Num: func(env *Env) float64 {
+		min, max := lo(env), hi(env)
+		if max-min > MaxTerms || math.IsNaN(max-min) {
+			return math.NaN()
+		}
+		e := env.Clone()
+		e.Args = append(e.Args[:slot], 0)
+		total := 0.0
+		if isProd {
+			total = 1
+		}
+		for i := min; i <= max; i++ {
+			e.Args[slot] = i
+			if isProd {
+				total *= f(e)
+			} else {
+				total += f(e)
+			}
+		}
+		return total
+	}}, nil
+}
+
+// WithLocal returns a copy of the context with the given local variable added after the other locals
+func (cx *Context) WithLocal(name string) *Context {
+	ncx := *cx
+	ncx.Locals = append(slices.Clone(cx.Locals), name)
+	return &ncx
+}
+
+// LocalIndex returns the index of the local variable with the given name in [Env.Args],
+// or -1 if there is none. Inner locals with the same name as outer ones take precedence.
+func (cx *Context) LocalIndex(name string) int {
+	for i := len(cx.Locals) - 1; i >= 0; i-- {
+		if cx.Locals[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Clone returns a copy of the environment that can be changed without changing env
+func (env *Env) Clone() *Env {
+	e := *env
+	if e.Args != nil {
+		e.Args = slices.Clone(e.Args)
+	}
+	return &e
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"math/rand/v2"
+	"slices"
+
+	"gonum.org/v1/gonum/spatial/r2"
+)
+
+// Env is the environment that a compiled expression is evaluated in.
+// Each variable has a fixed slot, so evaluation does not need any map lookups.
+// The environment is owned by the caller, and compiled expressions do not change
+// anything else while they are evaluated, so an expression can be evaluated in
+// parallel with different environments.
+type Env struct {
+	// X is the x value
+	X float64
+
+	// Y is the y value, used in GraphIf, Bounce and Params expressions
+	Y float64
+
+	// T is the time passed since the marbles were ran; a is 10*sin(t)
+	T float64
+
+	// H is the number of times the line has been hit
+	H float64
+
+	// N is the index of the marble, used in the marble start position and the expressions evaluated for a marble
+	N float64
+
+	// VX and VY are the velocity of the marble, used in the params and the GraphIf and Bounce of lines
+	VX, VY float64
+
+	// Age is the time since the marble started
+	Age float64
+
+	// Bounces is the number of times the marble has hit a line
+	Bounces float64
+
+	// Color is the color index of the marble; see [Marble.ColorIndex]
+	Color float64
+
+	// Hits are the numbers of times the marble has hit each line; see [Marble.Hits]
+	Hits []int
+
+	// Args are the values of the parameters of the helper function being evaluated
+	Args []float64
+
+	// State is the state that the evaluation changes, which is shared by the
+	// evaluations of the caller. If it is nil, a new one is made when it is needed.
+	State *EvalState
+}
+
+// EvalState is the state that evaluating expressions changes, like the random stream
+// and the memoized terms of sequences. Each caller that evaluates expressions,
+// like drawing the graph or updating a marble, has its own.
+type EvalState struct {
+	// Rand is the random stream that the random functions use
+	Rand *rand.Rand
+
+	// seqs are the memoized terms of the sequences that have been evaluated
+	seqs map[*Helper]*seqMemo
+
+	// ints are the cached integrals of the lines that have been evaluated
+	ints map[*Line]*integralCache
+
+	// MaxIntegrals is the largest number of values of F(x) that are cached for each line
+	MaxIntegrals int
+
+	// args is the stack of the arguments of the calls being evaluated, so that calls do not allocate them
+	args []float64
+}
+
+// pushArgs returns room for n arguments on top of the argument stack, along with the height of the stack
+// to give to [EvalState.popArgs] once the call that uses them returns. The room stays valid until then,
+// even if calls in the arguments or the call itself push more.
+func (st *EvalState) pushArgs(n int) ([]float64, int) {
+	top := len(st.args)
+	st.args = slices.Grow(st.args, n)[:top+n]
+	return st.args[top : top+n : top+n], top
+}
+
+// popArgs removes the arguments above the given height from the argument stack
+func (st *EvalState) popArgs(top int) {
+	st.args = st.args[:top]
+}
+
+// NewEvalState returns a new evaluation state that uses the given random stream
+func NewEvalState(r *rand.Rand) *EvalState {
+	return &EvalState{Rand: r, seqs: map[*Helper]*seqMemo{}, ints: map[*Line]*integralCache{}, MaxIntegrals: maxIntegralCache}
+}
+
+// state returns the evaluation state of the environment, making one with the
+// draw stream if it does not have one yet
+func (env *Env) state() *EvalState {
+	if env.State == nil {
+		env.State = NewEvalState(NewRand(DrawStream))
+	}
+	return env.State
+}
+
+// Kind is the kind of value that a compiled expression results in
+type Kind int
+
+const (
+	// KindNumber is a float64 value
+	KindNumber Kind = iota
+
+	// KindBool is a bool value
+	KindBool
+
+	// KindComplex is a complex128 value
+	KindComplex
+
+	// KindPoint is a point or vector with x and y components
+	KindPoint
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindBool:
+		return "bool"
+	case KindComplex:
+		return "complex128"
+	case KindPoint:
+		return "point"
+	}
+	return "float64"
+}
+
+// Compiled is a compiled expression, which is a typed closure over an [Env]
+type Compiled struct {
+	Kind Kind
+
+	// Num evaluates the expression if it is a [KindNumber]
+	Num func(env *Env) float64
+
+	// Bool evaluates the expression if it is a [KindBool]
+	Bool func(env *Env) bool
+
+	// Cplx evaluates the expression if it is a [KindComplex]
+	Cplx func(env *Env) complex128
+
+	// Pt evaluates the expression if it is a [KindPoint]
+	Pt func(env *Env) r2.Vec
+
+	// Const is whether the expression has the same value in every environment
+	Const bool
+}
+
+// compileError returns an error for the given node
+func compileError(n Node, format string, args ...any) error {
+	return &SyntaxError{n.Pos(), n.End(), fmt.Sprintf(format, args...)}
+}
+
+// numConst returns a compiled constant number
+func numConst(v float64) *Compiled {
+	return &Compiled{Kind: KindNumber, Num: func(env *Env) float64 { return v }, Const: true}
+}
+
+// boolConst returns a compiled constant bool
+func boolConst(v bool) *Compiled {
+	return &Compiled{Kind: KindBool, Bool: func(env *Env) bool { return v }, Const: true}
+}
+
+// fold evaluates a constant expression once so that it does not need to be evaluated again
+func (c *Compiled) fold() *Compiled {
+	if !c.Const {
+		return c
+	}
+	switch c.Kind {
+	case KindBool:
+		return boolConst(c.Bool(&Env{}))
+	case KindComplex:
+		return cplxConst(c.Cplx(&Env{}))
+	case KindPoint:
+		return pointConst(c.Pt(&Env{}))
+	}
+	return numConst(c.Num(&Env{}))
+}
+
+// CompileNode compiles a syntax tree into a closure using the names in the given context,
+// folding it into a single value if it is constant.
+func CompileNode(n Node, cx *Context) (*Compiled, error) {
+	c, err := compileNodeKind(n, cx)
+	if err != nil {
+		return nil, err
+	}
+	return c.fold(), nil
+}
+
+func compileNodeKind(n Node, cx *Context) (*Compiled, error) {
+	switch n := n.(type) {
+	case *NumberNode:
+		return numConst(n.Val), nil
+	case *BoolNode:
+		return boolConst(n.Val), nil
+	case *ParenNode:
+		return CompileNode(n.X, cx)
+	case *VarNode:
+		return compileVar(n, cx)
+	case *UnaryNode:
+		return compileUnary(n, cx)
+	case *BinaryNode:
+		return compileBinary(n, cx)
+	case *CallNode:
+		return compileCall(n, cx)
+	case *NumDerivNode:
+		return compileNumDeriv(n, cx)
+	case *PiecewiseNode:
+		return compilePiecewise(n, cx)
+	case *PointNode:
+		return compilePoint(n, cx)
+	case *MemberNode:
+		return compileMember(n, cx)
+	case *FuncNode:
+		return nil, compileError(n, "function %v needs an argument, like %v(x)", n.Name, n.Name)
+	}
+	return nil, compileError(n, "unsupported expression %v", n)
+}
+
+func compileVar(n *VarNode, cx *Context) (*Compiled, error) {
+	if i := cx.LocalIndex(n.Name); i >= 0 {
+		return &Compiled{Kind: KindNumber, Num: func(env *Env) float64 { return env.Args[i] }}, nil
+	}
+	var f func(env *Env) float64
+	switch n.Name {
+	case "π":
+		return numConst(math.Pi), nil
+	case "e":
+		return numConst(math.E), nil
+	case "i":
+		return cplxConst(1i), nil
+	case "x":
+		f = func(env *Env) float64 { return env.X }
+	case "y":
+		f = func(env *Env) float64 { return env.Y }
+	case "t":
+		f = func(env *Env) float64 { return env.T }
+	case "a":
+		f = func(env *Env) float64 { return 10 * math.Sin(env.T) }
+	case "h":
+		f = func(env *Env) float64 { return env.H }
+	case "n":
+		f = func(env *Env) float64 { return env.N }
+	case "vx":
+		f = func(env *Env) float64 { return env.VX }
+	case "vy":
+		f = func(env *Env) float64 { return env.VY }
+	case "speed":
+		f = func(env *Env) float64 { return math.Hypot(env.VX, env.VY) }
+	case "age":
+		f = func(env *Env) float64 { return env.Age }
+	case "bounces":
+		f = func(env *Env) float64 { return env.Bounces }
+	case "color":
+		f = func(env *Env) float64 { return env.Color }
+	default:
+		v := cx.Variables.Find(n.Name)
+		if v == nil {
+			return nil, compileError(n, "unknown variable %q", n.Name)
+		}
+		if v.Expr.Val == nil {
+			return nil, compileError(n, "variable %v has errors", n.Name)
+		}
+		return v.Expr.Val, nil
+	}
+	return &Compiled{Kind: KindNumber, Num: f}, nil
+}
+
+func compileUnary(n *UnaryNode, cx *Context) (*Compiled, error) {
+	x, err := CompileNode(n.X, cx)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op == "!" {
+		if x.Kind != KindBool {
+			return nil, compileError(n, "operator ! needs a bool value, not a %v value", x.Kind)
+		}
+		xf := x.Bool
+		return &Compiled{Kind: KindBool, Bool: func(env *Env) bool { return !xf(env) }, Const: x.Const}, nil
+	}
+	if x.Kind == KindPoint {
+		xf := x.Pt
+		return &Compiled{Kind: KindPoint, Pt: func(env *Env) r2.Vec { return r2.Scale(-1, xf(env)) }, Const: x.Const}, nil
+	}
+	if x.Kind == KindComplex {
+		xf := x.Cplx
+		return &Compiled{Kind: KindComplex, Cplx: func(env *Env) complex128 { return -xf(env) }, Const: x.Const}, nil
+	}
+	if x.Kind != KindNumber {
+		return nil, compileError(n, "operator %v needs a float64 value, not a %v value", n.Op, x.Kind)
+	}
+	xf := x.Num
+	return &Compiled{Kind: KindNumber, Num: func(env *Env) float64 { return -xf(env) }, Const: x.Const}, nil
+}
+
+func compileBinary(n *BinaryNode, cx *Context) (*Compiled, error) {
+	x, err := CompileNode(n.X, cx)
+	if err != nil {
+		return nil, err
+	}
+	y, err := CompileNode(n.Y, cx)
+	if err != nil {
+		return nil, err
+	}
+	res := &Compiled{Const: x.Const && y.Const}
+
+	if n.Op == "&&" || n.Op == "||" {
+		if x.Kind != KindBool || y.Kind != KindBool {
+			return nil, compileError(n, "operator %v needs bool values, not %v and %v values", n.Op, x.Kind, y.Kind)
+		}
+		xf, yf := x.Bool, y.Bool
+		res.Kind = KindBool
+		if n.Op == "&&" {
+			res.Bool = func(env *Env) bool { return xf(env) && yf(env) }
+		} else {
+			res.Bool = func(env *Env) bool { return xf(env) || yf(env) }
+		}
+		return res, nil
+	}
+
+	if x.Kind == KindBool && y.Kind == KindBool && (n.Op == "==" || n.Op == "!=") {
+		xf, yf := x.Bool, y.Bool
+		res.Kind = KindBool
+		if n.Op == "==" {
+			res.Bool = func(env *Env) bool { return xf(env) == yf(env) }
+		} else {
+			res.Bool = func(env *Env) bool { return xf(env) != yf(env) }
+		}
+		return res, nil
+	}
+
+	if x.Kind == KindPoint || y.Kind == KindPoint {
+		return compilePointBinary(n, x, y)
+	}
+	if x.Kind.isNumeric() && y.Kind.isNumeric() && (x.Kind == KindComplex || y.Kind == KindComplex) {
+		return compileComplexBinary(n, x, y)
+	}
+	if x.Kind != KindNumber || y.Kind != KindNumber {
+		return nil, compileError(n, "operator %v needs float64 values, not %v and %v values", n.Op, x.Kind, y.Kind)
+	}
+	xf, yf := x.Num, y.Num
+	switch n.Op {
+	case "+":
+		res.Num = func(env *Env) float64 { return xf(env) + yf(env) }
+	case "-":
+		res.Num = func(env *Env) float64 { return xf(env) - yf(env) }
+	case "*":
+		res.Num = func(env *Env) float64 { return xf(env) * yf(env) }
+	case "/":
+		res.Num = func(env *Env) float64 { return xf(env) / yf(env) }
+	case "%":
+		res.Num = func(env *Env) float64 { return math.Mod(xf(env), yf(env)) }
+	case "^":
+		if y.Const && y.Num(nil) == 2 {
+			res.Num = func(env *Env) float64 {
+				v := xf(env)
+				return v * v
+			}
+		} else {
+			res.Num = func(env *Env) float64 { return math.Pow(xf(env), yf(env)) }
+		}
+	}
+	if res.Num != nil {
+		res.Kind = KindNumber
+		return res, nil
+	}
+
+	res.Kind = KindBool
+	switch n.Op {
+	case "==":
+		res.Bool = func(env *Env) bool { return xf(env) == yf(env) }
+	case "!=":
+		res.Bool = func(env *Env) bool { return xf(env) != yf(env) }
+	case "<":
+		res.Bool = func(env *Env) bool { return xf(env) < yf(env) }
+	case "<=":
+		res.Bool = func(env *Env) bool { return xf(env) <= yf(env) }
+	case ">":
+		res.Bool = func(env *Env) bool { return xf(env) > yf(env) }
+	case ">=":
+		res.Bool = func(env *Env) bool { return xf(env) >= yf(env) }
+	default:
+		return nil, compileError(n, "unknown operator %v", n.Op)
+	}
+	return res, nil
+}
+
+func compileCall(n *CallNode, cx *Context) (*Compiled, error) {
+	switch n.Name {
+	case "if":
+		return compileIf(n, cx)
+	case "d":
+		return compileD(n, cx)
+	case "int":
+		return compileInt(n, cx)
+	case "sum", "prod":
+		return compileSum(n, cx)
+	case "dot", "len", "normalize", "rotate":
+		return compilePointCall(n, cx)
+	}
+	fn, ok := cx.Functions[n.Name]
+	if !ok {
+		return nil, compileError(n, "unknown function %q", n.Name)
+	}
+	if lo, hi := fn.ArgRange(); len(n.Args) < lo || (hi >= 0 && len(n.Args) > hi) {
+		if lo == hi {
+			return nil, compileError(n, "function %v needs %v arguments, not %v arguments", n.Name, lo, len(n.Args))
+		}
+		return nil, compileError(n, "function %v needs %v to %v arguments, not %v arguments", n.Name, lo, hi, len(n.Args))
+	}
+	if fn.Funcs > 0 {
+		return compileFuncsCall(n, fn, cx)
+	}
+	if fn.Lines > 0 {
+		return compileLinesCall(n, fn, cx)
+	}
+	cs := make([]*Compiled, len(n.Args))
+	hasComplex := false
+	for i, a := range n.Args {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		cs[i] = c
+		hasComplex = hasComplex || c.Kind == KindComplex
+	}
+	if hasComplex {
+		return compileComplexCall(n, cs)
+	}
+	args := make([]func(env *Env) float64, len(n.Args))
+	isConst := fn.Pure
+	for i, a := range n.Args {
+		c := cs[i]
+		if c.Kind != KindNumber {
+			return nil, compileError(a, "function %v needs float64 arguments, not a %v value for argument %v", n.Name, c.Kind, i)
+		}
+		args[i] = c.Num
+		isConst = isConst && c.Const
+	}
+	res := &Compiled{Kind: KindNumber, Const: isConst}
+	if len(args) == 1 && fn.Call1 != nil {
+		call, arg := fn.Call1, args[0]
+		res.Num = func(env *Env) float64 { return call(env, arg(env)) }
+		return res, nil
+	}
+	call := fn.Call
+	res.Num = func(env *Env) float64 {
+		st := env.state()
+		vals, top := st.pushArgs(len(args))
+		for i, arg := range args {
+			vals[i] = arg(env)
+		}
+		v := call(env, vals)
+		st.popArgs(top)
+		return v
+	}
+	return res, nil
+}
+
+// compileIf compiles if(condition, a, b), which only evaluates the branch that is chosen
+func compileIf(n *CallNode, cx *Context) (*Compiled, error) {
+	if len(n.Args) != 3 {
+		return nil, compileError(n, "function if needs 3 arguments, not %v arguments", len(n.Args))
+	}
+	cs := make([]*Compiled, 3)
+	for i, a := range n.Args {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		cs[i] = c
+	}
+	if cs[0].Kind != KindBool {
+		return nil, compileError(n.Args[0], "the condition of if needs to be a bool value, not a %v value", cs[0].Kind)
+	}
+	kind, ok := unifyKinds(cs[1], cs[2])
+	if !ok {
+		return nil, compileError(n, "both values of if need to be the same kind, not %v and %v values", cs[1].Kind, cs[2].Kind)
+	}
+	cond := cs[0].Bool
+	res := &Compiled{Kind: kind, Const: cs[0].Const && cs[1].Const && cs[2].Const}
+	if res.Kind == KindBool {
+		a, b := cs[1].Bool, cs[2].Bool
+		res.Bool = func(env *Env) bool {
+			if cond(env) {
+				return a(env)
+			}
+			return b(env)
+		}
+		return res, nil
+	}
+	if res.Kind == KindPoint {
+		a, b := cs[1].Pt, cs[2].Pt
+		res.Pt = func(env *Env) r2.Vec {
+			if cond(env) {
+				return a(env)
+			}
+			return b(env)
+		}
+		return res, nil
+	}
+	if res.Kind == KindComplex {
+		a, b := cs[1].complex(), cs[2].complex()
+		res.Cplx = func(env *Env) complex128 {
+			if cond(env) {
+				return a(env)
+			}
+			return b(env)
+		}
+		return res, nil
+	}
+	a, b := cs[1].Num, cs[2].Num
+	res.Num = func(env *Env) float64 {
+		if cond(env) {
+			return a(env)
+		}
+		return b(env)
+	}
+	return res, nil
+}
+
+// compilePiecewise compiles a piecewise expression, which is NaN (or false) where
+// none of the conditions are true and there is no value without a condition
+func compilePiecewise(n *PiecewiseNode, cx *Context) (*Compiled, error) {
+	conds := make([]func(env *Env) bool, len(n.Conds))
+	vals := make([]*Compiled, len(n.Vals))
+	isConst := true
+	for i, c := range n.Conds {
+		cc, err := CompileNode(c, cx)
+		if err != nil {
+			return nil, err
+		}
+		if cc.Kind != KindBool {
+			return nil, compileError(c, "the condition of a piecewise case needs to be a bool value, not a %v value", cc.Kind)
+		}
+		vc, err := CompileNode(n.Vals[i], cx)
+		if err != nil {
+			return nil, err
+		}
+		conds[i] = cc.Bool
+		vals[i] = vc
+		isConst = isConst && cc.Const && vc.Const
+	}
+	var els *Compiled
+	if n.Else != nil {
+		var err error
+		els, err = CompileNode(n.Else, cx)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, els)
+		isConst = isConst && els.Const
+	}
+	kind, ok := unifyKinds(vals...)
+	for i, v := range vals {
+		if !ok && v.Kind != vals[0].Kind {
+			vn := n.Else
+			if i < len(n.Vals) {
+				vn = n.Vals[i]
+			}
+			return nil, compileError(vn, "all values of a piecewise expression need to be the same kind, not %v and %v values", vals[0].Kind, v.Kind)
+		}
+	}
+	res := &Compiled{Kind: kind, Const: isConst}
+	if kind == KindBool {
+		bs := make([]func(env *Env) bool, len(vals))
+		for i, v := range vals {
+			bs[i] = v.Bool
+		}
+		res.Bool = func(env *Env) bool {
+			for i, c := range conds {
+				if c(env) {
+					return bs[i](env)
+				}
+			}
+			if els != nil {
+				return bs[len(conds)](env)
+			}
+			return false
+		}
+		return res, nil
+	}
+	if kind == KindPoint {
+		ps := make([]func(env *Env) r2.Vec, len(vals))
+		for i, v := range vals {
+			ps[i] = v.Pt
+		}
+		res.Pt = func(env *Env) r2.Vec {
+			for i, c := range conds {
+				if c(env) {
+					return ps[i](env)
+				}
+			}
+			if els != nil {
+				return ps[len(conds)](env)
+			}
+			return r2.Vec{X: math.NaN(), Y: math.NaN()}
+		}
+		return res, nil
+	}
+	if kind == KindComplex {
+		zs := make([]func(env *Env) complex128, len(vals))
+		for i, v := range vals {
+			zs[i] = v.complex()
+		}
+		res.Cplx = func(env *Env) complex128 {
+			for i, c := range conds {
+				if c(env) {
+					return zs[i](env)
+				}
+			}
+			if els != nil {
+				return zs[len(conds)](env)
+			}
+			return cmplx.NaN()
+		}
+		return res, nil
+	}
+	fs := make([]func(env *Env) float64, len(vals))
+	for i, v := range vals {
+		fs[i] = v.Num
+	}
+	res.Num = func(env *Env) float64 {
+		for i, c := range conds {
+			if c(env) {
+				return fs[i](env)
+			}
+		}
+		if els != nil {
+			return fs[len(conds)](env)
+		}
+		return math.NaN()
+	}
+	return res, nil
+}
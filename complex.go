@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// ComplexFunctions are the versions of the default functions that take and return complex values,
+// which are used when a function is called with a complex argument
+var ComplexFunctions = map[string]func(z complex128) complex128{
+	"exp":     cmplx.Exp,
+	"ln":      cmplx.Log,
+	"sqrt":    cmplx.Sqrt,
+	"sin":     cmplx.Sin,
+	"cos":     cmplx.Cos,
+	"tan":     cmplx.Tan,
+	"cot":     cmplx.Cot,
+	"sec":     func(z complex128) complex128 { return 1 / cmplx.Cos(z) },
+	"csc":     func(z complex128) complex128 { return 1 / cmplx.Sin(z) },
+	"sinh":    cmplx.Sinh,
+	"cosh":    cmplx.Cosh,
+	"tanh":    cmplx.Tanh,
+	"arcsin":  cmplx.Asin,
+	"arccos":  cmplx.Acos,
+	"arctan":  cmplx.Atan,
+	"arcsinh": cmplx.Asinh,
+	"arccosh": cmplx.Acosh,
+	"arctanh": cmplx.Atanh,
+	"conj":    cmplx.Conj,
+}
+
+// ComplexRealFunctions are the functions that take a complex value and return a real value
+var ComplexRealFunctions = map[string]func(z complex128) float64{
+	"re":  func(z complex128) float64 { return real(z) },
+	"im":  func(z complex128) float64 { return imag(z) },
+	"arg": cmplx.Phase,
+	"abs": cmplx.Abs,
+}
+
+// cplxConst returns a compiled constant complex value
+func cplxConst(v complex128) *Compiled {
+	return &Compiled{Kind: KindComplex, Cplx: func(env *Env) complex128 { return v }, Const: true}
+}
+
+// complex returns the function that evaluates a number or complex expression as a complex value
+func (c *Compiled) complex() func(env *Env) complex128 {
+	if c.Kind == KindComplex {
+		return c.Cplx
+	}
+	f := c.Num
+	return func(env *Env) complex128 { return complex(f(env), 0) }
+}
+
+// isNumeric returns whether the kind is a number or complex value
+func (k Kind) isNumeric() bool {
+	return k == KindNumber || k == KindComplex
+}
+
+// unifyKinds returns the kind that all of the given values can be converted to,
+// which is complex if some of them are complex and the rest are numbers
+func unifyKinds(cs ...*Compiled) (Kind, bool) {
+	kind := cs[0].Kind
+	for _, c := range cs[1:] {
+		switch {
+		case c.Kind == kind:
+		case kind.isNumeric() && c.Kind.isNumeric():
+			kind = KindComplex
+		default:
+			return kind, false
+		}
+	}
+	return kind, true
+}
+
+// compileComplexBinary compiles a binary operation on two numeric values where at least one is complex
+func compileComplexBinary(n *BinaryNode, x, y *Compiled) (*Compiled, error) {
+	xf, yf := x.complex(), y.complex()
+	res := &Compiled{Kind: KindComplex, Const: x.Const && y.Const}
+	switch n.Op {
+	case "+":
+		res.Cplx = func(env *Env) complex128 { return xf(env) + yf(env) }
+	case "-":
+		res.Cplx = func(env *Env) complex128 { return xf(env) - yf(env) }
+	case "*":
+		res.Cplx = func(env *Env) complex128 { return xf(env) * yf(env) }
+	case "/":
+		res.Cplx = func(env *Env) complex128 { return xf(env) / yf(env) }
+	case "^":
+		res.Cplx = func(env *Env) complex128 { return cmplx.Pow(xf(env), yf(env)) }
+	case "==":
+		res.Kind = KindBool
+		res.Bool = func(env *Env) bool { return xf(env) == yf(env) }
+	case "!=":
+		res.Kind = KindBool
+		res.Bool = func(env *Env) bool { return xf(env) != yf(env) }
+	default:
+		return nil, compileError(n, "operator %v can not be used with complex128 values", n.Op)
+	}
+	return res, nil
+}
+
+// compileComplexCall compiles a call with at least one complex argument using
+// [ComplexFunctions] and [ComplexRealFunctions]
+func compileComplexCall(n *CallNode, cs []*Compiled) (*Compiled, error) {
+	isConst := true
+	for _, c := range cs {
+		isConst = isConst && c.Const
+	}
+	if len(cs) == 2 && n.Name == "pow" {
+		xf, yf := cs[0].complex(), cs[1].complex()
+		return &Compiled{Kind: KindComplex, Const: isConst, Cplx: func(env *Env) complex128 { return cmplx.Pow(xf(env), yf(env)) }}, nil
+	}
+	if len(cs) == 1 {
+		arg := cs[0].complex()
+		if f, ok := ComplexFunctions[n.Name]; ok {
+			return &Compiled{Kind: KindComplex, Const: isConst, Cplx: func(env *Env) complex128 { return f(arg(env)) }}, nil
+		}
+		if f, ok := ComplexRealFunctions[n.Name]; ok {
+			return &Compiled{Kind: KindNumber, Const: isConst, Num: func(env *Env) float64 { return f(arg(env)) }}, nil
+		}
+	}
+	return nil, compileError(n, "function %v can not be used with complex128 values", n.Name)
+}
+
+// realValue returns the real value of the given complex value, and whether it is real.
+// A value with a NaN part is NaN, so that it is a gap in the line.
+func realValue(z complex128) (float64, bool) {
+	re, im := real(z), imag(z)
+	if math.IsNaN(re) || math.IsNaN(im) {
+		return math.NaN(), true
+	}
+	if math.Abs(im) > 1e-10*max(1, math.Abs(re)) {
+		return math.NaN(), false
+	}
+	return re, true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"slices"
+
+	"cogentcore.org/core/math32"
+	"gonum.org/v1/gonum/spatial/r2"
+)
+
+// Crowd is a snapshot of the marbles, which expressions use through functions like count and meanx.
+// It is taken once per step, so that the values do not depend on the order that the marbles are updated in.
+type Crowd struct {
+
+	// Pos are the positions of all of the marbles
+	Pos []math32.Vector2
+
+	// grid has the positions bucketed into cells, so that [Crowd.Count] does not need to look at all of them
+	grid crowdGrid
+
+	// Alive is the number of marbles that are in the bounds of the graph
+	Alive int
+
+	// MeanX and MeanY are the mean position of the marbles that are in the bounds of the graph
+	MeanX, MeanY float64
+
+	// MaxY is the largest y of the marbles that are in the bounds of the graph
+	MaxY float64
+}
+
+// NewCrowd makes a snapshot of the given marbles, using the given bounds to find which of them are alive
+func NewCrowd(marbles []*Marble, vecs *Vectors) *Crowd {
+	c := &Crowd{Pos: make([]math32.Vector2, len(marbles)), MeanX: math.NaN(), MeanY: math.NaN(), MaxY: math.NaN()}
+	sx, sy, my := 0.0, 0.0, math.Inf(-1)
+	for i, m := range marbles {
+		c.Pos[i] = m.Pos
+		if !vecs.InBounds(m.Pos) {
+			continue
+		}
+		c.Alive++
+		sx += float64(m.Pos.X)
+		sy += float64(m.Pos.Y)
+		my = max(my, float64(m.Pos.Y))
+	}
+	if c.Alive > 0 {
+		c.MeanX, c.MeanY, c.MaxY = sx/float64(c.Alive), sy/float64(c.Alive), my
+	}
+	c.grid.init(c.Pos)
+	return c
+}
+
+// Count returns the number of marbles in the box with corners (x1, y1) and (x2, y2), including its edges
+func (c *Crowd) Count(x1, y1, x2, y2 float64) float64 {
+	x1, x2 = min(x1, x2), max(x1, x2)
+	y1, y2 = min(y1, y2), max(y1, y2)
+	return float64(c.grid.count(x1, y1, x2, y2))
+}
+
+// crowdGrid is a grid of square-ish cells over the positions of the marbles, with the number of positions
+// in every block of cells from the first one, so that a box of cells is counted at once
+// and only the positions in the cells on its edges are compared with it
+type crowdGrid struct {
+
+	// size is the number of cells in each direction
+	size int
+
+	// min is the corner of the first cell, and cell is the size of each cell
+	min, cell r2.Vec
+
+	// starts are where the positions of each cell start in pos, with one more at the end
+	starts []int
+
+	// pos are the positions ordered by their cell
+	pos []r2.Vec
+
+	// sums are the numbers of positions in the cells before each column and row, with size+1 of each
+	sums []int
+
+	// others are the positions that are not finite, which are compared with every box
+	others []r2.Vec
+}
+
+// init buckets the given positions into the grid
+func (g *crowdGrid) init(ps []math32.Vector2) {
+	lo, hi := r2.Vec{X: math.Inf(1), Y: math.Inf(1)}, r2.Vec{X: math.Inf(-1), Y: math.Inf(-1)}
+	finite := make([]r2.Vec, 0, len(ps))
+	for _, p := range ps {
+		v := r2.Vec{X: float64(p.X), Y: float64(p.Y)}
+		if math.IsNaN(v.X) || math.IsNaN(v.Y) || math.IsInf(v.X, 0) || math.IsInf(v.Y, 0) {
+			g.others = append(g.others, v)
+			continue
+		}
+		finite = append(finite, v)
+		lo = r2.Vec{X: min(lo.X, v.X), Y: min(lo.Y, v.Y)}
+		hi = r2.Vec{X: max(hi.X, v.X), Y: max(hi.Y, v.Y)}
+	}
+	if len(finite) == 0 {
+		return
+	}
+	g.size = max(1, min(64, int(math.Sqrt(float64(len(finite))))))
+	g.min = lo
+	g.cell = r2.Scale(1/float64(g.size), r2.Sub(hi, lo))
+	if g.cell.X == 0 {
+		g.cell.X = 1
+	}
+	if g.cell.Y == 0 {
+		g.cell.Y = 1
+	}
+	cells := make([]int, len(finite))
+	counts := make([]int, g.size*g.size)
+	for i, v := range finite {
+		cells[i] = g.row(v.Y)*g.size + g.col(v.X)
+		counts[cells[i]]++
+	}
+	g.starts = make([]int, len(counts)+1)
+	for i, n := range counts {
+		g.starts[i+1] = g.starts[i] + n
+	}
+	g.pos = make([]r2.Vec, len(finite))
+	next := slices.Clone(g.starts[:len(counts)])
+	for i, v := range finite {
+		g.pos[next[cells[i]]] = v
+		next[cells[i]]++
+	}
+	w := g.size + 1
+	g.sums = make([]int, w*w)
+	for r := range g.size {
+		for c := range g.size {
+			g.sums[(r+1)*w+c+1] = counts[r*g.size+c] + g.sums[r*w+c+1] + g.sums[(r+1)*w+c] - g.sums[r*w+c]
+		}
+	}
+}
+
+// col returns the column of the cell that has the given x, limited to the grid
+func (g *crowdGrid) col(x float64) int {
+	return g.index((x - g.min.X) / g.cell.X)
+}
+
+// row returns the row of the cell that has the given y, limited to the grid
+func (g *crowdGrid) row(y float64) int {
+	return g.index((y - g.min.Y) / g.cell.Y)
+}
+
+// index returns the index of the cell at the given offset in cells, limited to the grid
+func (g *crowdGrid) index(f float64) int {
+	switch {
+	case f < 0:
+		return 0
+	case f >= float64(g.size):
+		return g.size - 1
+	}
+	return int(f)
+}
+
+// count returns the number of positions in the box from (x1, y1) to (x2, y2), including its edges
+func (g *crowdGrid) count(x1, y1, x2, y2 float64) int {
+	in := func(v r2.Vec) bool { return v.X >= x1 && v.X <= x2 && v.Y >= y1 && v.Y <= y2 }
+	n := 0
+	for _, v := range g.others {
+		if in(v) {
+			n++
+		}
+	}
+	if g.size == 0 || math.IsNaN(x1) || math.IsNaN(y1) || math.IsNaN(x2) || math.IsNaN(y2) {
+		return n
+	}
+	c1, c2, row1, row2 := g.col(x1), g.col(x2), g.row(y1), g.row(y2)
+	// the cells strictly inside the box of cells are inside the box, so they are counted at once
+	if c2-c1 > 1 && row2-row1 > 1 {
+		w := g.size + 1
+		n += g.sums[row2*w+c2] - g.sums[(row1+1)*w+c2] - g.sums[row2*w+c1+1] + g.sums[(row1+1)*w+c1+1]
+	}
+	// and the positions in the cells on its edges are compared with it
+	for r := row1; r <= row2; r++ {
+		step := 1
+		if r != row1 && r != row2 {
+			step = max(1, c2-c1)
+		}
+		for c := c1; c <= c2; c += step {
+			cell := r*g.size + c
+			for _, v := range g.pos[g.starts[cell]:g.starts[cell+1]] {
+				if in(v) {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// Crowd returns the latest snapshot of the marbles, which is empty before there are any marbles
+func (gr *Graph) Crowd() *Crowd {
+	if c := gr.State.Crowd.Load(); c != nil {
+		return c
+	}
+	return NewCrowd(nil, &gr.Vectors)
+}
+
+// UpdateCrowd takes a new snapshot of the marbles. It must be called while holding [Graph.StateMu]
+// or when nothing else is using the marbles.
+func (gr *Graph) UpdateCrowd() {
+	gr.State.Crowd.Store(NewCrowd(gr.Marbles, &gr.Vectors))
+}
+
+// CrowdFunctions are the names of the functions that use the snapshot of the marbles, so expressions that call them change over time
+var CrowdFunctions = []string{"count", "meanx", "meany", "maxy", "nalive"}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DepVars are the built-in variables that are reported in [Deps]
+var DepVars = append([]string{"x", "y", "t", "a", "h"}, MarbleVars...)
+
+// Deps are the things that an expression depends on, found from its syntax tree
+type Deps struct {
+
+	// Vars are the built-in variables in [DepVars] that the expression uses
+	Vars []string
+
+	// Lines are the indices of the lines whose functions the expression calls, like f, f' or F
+	Lines []int
+
+	// Helpers are the names of the helpers that the expression calls
+	Helpers []string
+
+	// Variables are the names of the graph variables that the expression uses
+	Variables []string
+
+	// Marbles is whether the expression uses the marbles through [CrowdFunctions]
+	Marbles bool
+
+	// Hits is whether the expression uses when lines were hit through functions with [Function.Lines], like hits(f)
+	Hits bool
+}
+
+// Uses returns whether the expression uses any of the given built-in variables
+func (d *Deps) Uses(names ...string) bool {
+	return slices.ContainsFunc(d.Vars, func(v string) bool { return slices.Contains(names, v) })
+}
+
+// Changes returns whether the value of the expression changes over time, which is the case
+// if it uses t, a, h, the marbles, the hits of lines or a variable that does not have a constant value
+func (d *Deps) Changes() bool {
+	if d.Uses("t", "a", "h") || d.Marbles || d.Hits {
+		return true
+	}
+	for _, name := range d.Variables {
+		if v := TheGraph.Variables.Find(name); v != nil && (v.Expr.Val == nil || !v.Expr.Val.Const) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVar adds the given built-in variable if it has not been added yet
+func (d *Deps) addVar(name string) {
+	if !slices.Contains(d.Vars, name) {
+		d.Vars = append(d.Vars, name)
+	}
+}
+
+// LineOf returns the index of the line that has the function with the given name, like f, f' or F, or -1
+func (gr *Graph) LineOf(name string) int {
+	return slices.IndexFunc(gr.Lines, func(ln *Line) bool {
+		return len(ln.Diags) == 0 && slices.Contains(ln.FunctionNames(), name)
+	})
+}
+
+// DirectDeps returns what the given expression uses directly, without following the lines,
+// helpers and variables that it uses. The variables in bound are parameters, which are not reported.
+func (gr *Graph) DirectDeps(n Node, bound ...string) Deps {
+	d := Deps{}
+	gr.addDeps(&d, n, bound)
+	return d
+}
+
+// addDeps adds what the given expression uses directly to d
+func (gr *Graph) addDeps(d *Deps, n Node, bound []string) {
+	if n == nil {
+		return
+	}
+	Walk(n, func(n Node) bool {
+		switch n := n.(type) {
+		case *VarNode:
+			switch {
+			case slices.Contains(bound, n.Name):
+			case slices.Contains(DepVars, n.Name):
+				d.addVar(n.Name)
+			case gr.Variables.Find(n.Name) != nil && !slices.Contains(d.Variables, n.Name):
+				d.Variables = append(d.Variables, n.Name)
+			}
+		case *CallNode:
+			// the index of sum and prod and the variable of int are bound in their body
+			if len(n.Args) == 4 && (n.Name == "sum" || n.Name == "prod" || n.Name == "int") {
+				body, iv := n.Args[3], n.Args[0]
+				free := n.Args[1:3]
+				if n.Name == "int" {
+					body, iv = n.Args[0], n.Args[1]
+					free = n.Args[2:]
+				}
+				if v, ok := opVar(iv); ok {
+					for _, a := range free {
+						gr.addDeps(d, a, bound)
+					}
+					gr.addDeps(d, body, append(slices.Clip(bound), v))
+					return false
+				}
+			}
+			// the lines in hits(f) and the like are only used for when they were hit
+			if fn := gr.Functions[n.Name]; fn != nil && fn.Lines > 0 && len(n.Args) >= fn.Lines {
+				d.Hits = true
+				for _, a := range n.Args[fn.Lines:] {
+					gr.addDeps(d, a, bound)
+				}
+				return false
+			}
+			gr.addCall(d, n.Name)
+		case *FuncNode:
+			gr.addCall(d, n.Name)
+		}
+		return true
+	})
+}
+
+// addCall adds the line or helper that has the function with the given name to d
+func (gr *Graph) addCall(d *Deps, name string) {
+	if slices.Contains(CrowdFunctions, name) {
+		d.Marbles = true
+		return
+	}
+	if k := gr.LineOf(name); k >= 0 {
+		if !slices.Contains(d.Lines, k) {
+			d.Lines = append(d.Lines, k)
+		}
+		if name == gr.Lines[k].Name+"h" { // fh uses the times f was hit
+			d.addVar("h")
+		}
+		return
+	}
+	if h := gr.Helpers.Find(name); h != nil && !slices.Contains(d.Helpers, name) {
+		d.Helpers = append(d.Helpers, name)
+	}
+}
+
+// ExprDeps returns everything that the given expression uses, directly or through the lines, helpers
+// and variables that it uses. The x of the lines and the parameters of the helpers are their arguments,
+// so they are not reported for them.
+func (gr *Graph) ExprDeps(n Node) Deps {
+	d := gr.DirectDeps(n)
+	gr.followDeps(&d)
+	return d
+}
+
+// HelperDeps returns everything that the body and base cases of the given helper use, directly or
+// through the lines, helpers and variables that they use, except for the parameters of the helper
+func (gr *Graph) HelperDeps(h *Helper) Deps {
+	d := gr.DirectDeps(h.Node, h.Params...)
+	for _, b := range h.Bases {
+		gr.addDeps(&d, b.Node, h.Params)
+	}
+	gr.followDeps(&d)
+	return d
+}
+
+// followDeps adds what the lines, helpers and variables in d use to d, until there is nothing new
+func (gr *Graph) followDeps(d *Deps) {
+	li, hi, vi := 0, 0, 0
+	for li < len(d.Lines) || hi < len(d.Helpers) || vi < len(d.Variables) {
+		for ; li < len(d.Lines); li++ {
+			gr.addDeps(d, gr.Lines[d.Lines[li]].Expr.Node, []string{"x"})
+		}
+		for ; hi < len(d.Helpers); hi++ {
+			h := gr.Helpers.Find(d.Helpers[hi])
+			gr.addDeps(d, h.Node, h.Params)
+			for _, b := range h.Bases {
+				gr.addDeps(d, b.Node, h.Params)
+			}
+		}
+		for ; vi < len(d.Variables); vi++ {
+			gr.addDeps(d, gr.Variables.Find(d.Variables[vi]).Expr.Node, nil)
+		}
+	}
+}
+
+// CheckCycles reports an error on each line, helper and variable in a circle of definitions that goes through
+// a line or a variable, which names the path of the circle, like "circular definitions: k -> f -> k". It removes their
+// syntax trees so that they are not compiled. Circles of only helpers are found by [Graph.CheckHelperCycles] and circles
+// of only variables by [Graph.VariableOrder] instead. Everything needs to be parsed first. It returns the first error.
+func (gr *Graph) CheckCycles() error {
+	deps := map[string]Deps{}
+	kinds := map[string]string{}
+	names := []string{}
+	add := func(name, kind string, d Deps) {
+		deps[name], kinds[name] = d, kind
+		names = append(names, name)
+	}
+	for _, ln := range gr.Lines {
+		if ln.Name == "" || len(ln.Diags) > 0 || ln.Expr.Node == nil {
+			continue
+		}
+		add(ln.Name, "line", gr.DirectDeps(ln.Expr.Node, "x"))
+	}
+	for _, h := range gr.Helpers {
+		if h.IsBase || h.Node == nil {
+			continue
+		}
+		d := gr.DirectDeps(h.Node, h.Params...)
+		for _, b := range h.Bases {
+			gr.addDeps(&d, b.Node, h.Params)
+		}
+		add(h.Name, "helper", d)
+	}
+	for _, v := range gr.Variables {
+		if v.Expr.Node == nil {
+			continue
+		}
+		add(v.Name, "variable", gr.DirectDeps(v.Expr.Node))
+	}
+	reported := map[string]bool{}
+	report := func(name string, err error) {
+		if reported[name] {
+			return
+		}
+		reported[name] = true
+		switch kinds[name] {
+		case "line":
+			ln := gr.Lines[slices.IndexFunc(gr.Lines, func(ln *Line) bool { return ln.Name == name })]
+			ln.Expr.Val, ln.Expr.Node = nil, nil
+			ln.Expr.Report(err)
+		case "helper":
+			h := gr.Helpers.Find(name)
+			h.Node = nil
+			h.Report(err)
+		case "variable":
+			v := gr.Variables.Find(name)
+			v.Expr.Val, v.Expr.Node = nil, nil
+			v.Expr.Report(err)
+		}
+	}
+	var first error
+	state := map[string]int{} // 1 = visiting, 2 = done
+	var visit func(name string, path []string)
+	visit = func(name string, path []string) {
+		state[name] = 1
+		path = append(path, name)
+		d := deps[name]
+		uses := append(slices.Clone(d.Helpers), d.Variables...)
+		for _, k := range d.Lines {
+			uses = append(uses, gr.Lines[k].Name)
+		}
+		for _, u := range uses {
+			if kinds[u] == "" {
+				continue
+			}
+			switch state[u] {
+			case 0:
+				visit(u, path)
+			case 1:
+				cycle := path[slices.Index(path, u):]
+				if !slices.ContainsFunc(cycle, func(s string) bool { return kinds[s] != kinds[u] || kinds[s] == "line" }) {
+					continue
+				}
+				err := fmt.Errorf("circular definitions: %v", strings.Join(append(slices.Clone(cycle), u), " -> "))
+				if first == nil {
+					first = err
+				}
+				for _, s := range cycle {
+					report(s, err)
+				}
+			}
+		}
+		state[name] = 2
+	}
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name, nil)
+		}
+	}
+	return first
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"math"
+	"slices"
+
+	"gonum.org/v1/gonum/diff/fd"
+)
+
+// NumDerivNode is the derivative of an expression with respect to a variable,
+// computed with finite differences. It is used by [Derivative] for expressions
+// that it can not differentiate symbolically.
+type NumDerivNode struct {
+	X   Node
+	Var string
+}
+
+func (n *NumDerivNode) Pos() int { return n.X.Pos() }
+func (n *NumDerivNode) End() int { return n.X.End() }
+
+func (n *NumDerivNode) String() string {
+	return "d(" + n.X.String() + ", " + n.Var + ")"
+}
+
+// DerivRules are the derivatives of the one-argument default functions,
+// as a function of the argument u. The chain rule is applied by [Derivative].
+var DerivRules = map[string]func(u Node) Node{
+	"sin": func(u Node) Node { return call("cos", u) },
+	"cos": func(u Node) Node { return neg(call("sin", u)) },
+	"tan": func(u Node) Node { return pow(call("sec", u), num(2)) },
+	"sec": func(u Node) Node { return mul(call("sec", u), call("tan", u)) },
+	"csc": func(u Node) Node { return neg(mul(call("csc", u), call("cot", u))) },
+	"cot": func(u Node) Node { return neg(pow(call("csc", u), num(2))) },
+	"arcsin": func(u Node) Node {
+		return div(num(1), call("sqrt", sub(num(1), pow(u, num(2)))))
+	},
+	"arccos": func(u Node) Node {
+		return neg(div(num(1), call("sqrt", sub(num(1), pow(u, num(2))))))
+	},
+	"arctan": func(u Node) Node { return div(num(1), add(num(1), pow(u, num(2)))) },
+	"arcsec": func(u Node) Node {
+		return div(num(1), mul(call("abs", u), call("sqrt", sub(pow(u, num(2)), num(1)))))
+	},
+	"arccsc": func(u Node) Node {
+		return neg(div(num(1), mul(call("abs", u), call("sqrt", sub(pow(u, num(2)), num(1))))))
+	},
+	"arccot": func(u Node) Node { return neg(div(num(1), add(num(1), pow(u, num(2))))) },
+	"sinh":   func(u Node) Node { return call("cosh", u) },
+	"cosh":   func(u Node) Node { return call("sinh", u) },
+	"tanh":   func(u Node) Node { return pow(call("sech", u), num(2)) },
+	"sech":   func(u Node) Node { return neg(mul(call("sech", u), call("tanh", u))) },
+	"csch":   func(u Node) Node { return neg(mul(call("csch", u), call("coth", u))) },
+	"coth":   func(u Node) Node { return neg(pow(call("csch", u), num(2))) },
+	"arcsinh": func(u Node) Node {
+		return div(num(1), call("sqrt", add(pow(u, num(2)), num(1))))
+	},
+	"arccosh": func(u Node) Node {
+		return div(num(1), call("sqrt", sub(pow(u, num(2)), num(1))))
+	},
+	"arctanh": func(u Node) Node { return div(num(1), sub(num(1), pow(u, num(2)))) },
+	"arcsech": func(u Node) Node {
+		return neg(div(num(1), mul(u, call("sqrt", sub(num(1), pow(u, num(2)))))))
+	},
+	"arccsch": func(u Node) Node {
+		return neg(div(num(1), mul(call("abs", u), call("sqrt", add(num(1), pow(u, num(2)))))))
+	},
+	"arccoth": func(u Node) Node { return div(num(1), sub(num(1), pow(u, num(2)))) },
+	"ln":      func(u Node) Node { return div(num(1), u) },
+	"abs":     func(u Node) Node { return div(u, call("abs", u)) },
+	"exp":     func(u Node) Node { return call("exp", u) },
+	"sqrt":    func(u Node) Node { return div(num(1), mul(num(2), call("sqrt", u))) },
+	"cbrt":    func(u Node) Node { return div(num(1), mul(num(3), pow(call("cbrt", u), num(2)))) },
+	"floor":   func(u Node) Node { return num(0) },
+	"ceil":    func(u Node) Node { return num(0) },
+	"round":   func(u Node) Node { return num(0) },
+	"sign":    func(u Node) Node { return num(0) },
+	"frac":    func(u Node) Node { return num(1) },
+	"erf":     func(u Node) Node { return mul(num(2/math.SqrtPi), call("exp", neg(pow(u, num(2))))) },
+	"erfc":    func(u Node) Node { return mul(num(-2/math.SqrtPi), call("exp", neg(pow(u, num(2))))) },
+	"J0":      func(u Node) Node { return neg(call("J1", u)) },
+	"square":  func(u Node) Node { return num(0) },
+	"saw":     func(u Node) Node { return num(1 / math.Pi) },
+	"deg":     func(u Node) Node { return num(180 / math.Pi) },
+	"rad":     func(u Node) Node { return num(math.Pi / 180) },
+}
+
+// Derivative returns the derivative of the given expression with respect to the
+// variable with the given name. The default functions in [DerivRules], powers,
+// logarithms, graph variables and functions with a [Function.Deriv] (like line functions)
+// are differentiated symbolically, and everything else falls back on a [NumDerivNode].
+func Derivative(n Node, v string, cx *Context) Node {
+	switch n := n.(type) {
+	case *NumberNode, *BoolNode:
+		return num(0)
+	case *VarNode:
+		if n.Name == v {
+			return num(1)
+		}
+		if slices.Contains(cx.Locals, n.Name) {
+			return num(0)
+		}
+		if n.Name == "a" && v == "t" {
+			return mul(num(10), call("cos", &VarNode{Name: "t"}))
+		}
+		if gv := cx.Variables.Find(n.Name); gv != nil && gv.Expr.Node != nil {
+			return Derivative(gv.Expr.Node, v, cx)
+		}
+		return num(0)
+	case *ParenNode:
+		return Derivative(n.X, v, cx)
+	case *UnaryNode:
+		if n.Op == "-" {
+			return neg(Derivative(n.X, v, cx))
+		}
+	case *BinaryNode:
+		dx := Derivative(n.X, v, cx)
+		dy := Derivative(n.Y, v, cx)
+		switch n.Op {
+		case "+":
+			return add(dx, dy)
+		case "-":
+			return sub(dx, dy)
+		case "*":
+			return add(mul(dx, n.Y), mul(n.X, dy))
+		case "/":
+			return div(sub(mul(dx, n.Y), mul(n.X, dy)), pow(n.Y, num(2)))
+		case "^":
+			return powDerivative(n.X, n.Y, dx, dy)
+		case "%":
+			if isNum(dy, 0) {
+				return dx
+			}
+		}
+	case *CallNode:
+		switch {
+		case n.Name == "d" && len(n.Args) == 2:
+			if dv, ok := opVar(n.Args[1]); ok {
+				return Derivative(Derivative(n.Args[0], dv, cx), v, cx)
+			}
+		case n.Name == "int" && len(n.Args) == 4:
+			if iv, ok := opVar(n.Args[1]); ok {
+				return intDerivative(n, iv, v, cx)
+			}
+		case n.Name == "dot" || n.Name == "len" || n.Name == "rotate":
+			if d := pointDerivative(n, v, cx); d != nil {
+				return d
+			}
+		case n.Name == "sum" && len(n.Args) == 4:
+			if iv, ok := opVar(n.Args[0]); ok && iv != v {
+				return call("sum", n.Args[0], n.Args[1], n.Args[2], Derivative(n.Args[3], v, cx.WithLocal(iv)))
+			}
+		}
+		return callDerivative(n, v, cx)
+	case *PointNode:
+		return &PointNode{X: Derivative(n.X, v, cx), Y: Derivative(n.Y, v, cx)}
+	case *MemberNode:
+		return &MemberNode{X: Derivative(n.X, v, cx), Field: n.Field}
+	case *PiecewiseNode:
+		d := &PiecewiseNode{Conds: n.Conds}
+		for _, val := range n.Vals {
+			d.Vals = append(d.Vals, Derivative(val, v, cx))
+		}
+		if n.Else != nil {
+			d.Else = Derivative(n.Else, v, cx)
+		}
+		return d
+	}
+	return &NumDerivNode{X: n, Var: v}
+}
+
+// powDerivative returns the derivative of u^w given the derivatives of u and w
+func powDerivative(u, w, du, dw Node) Node {
+	if isNum(dw, 0) {
+		return mul(mul(w, pow(u, sub(w, num(1)))), du)
+	}
+	if isNum(du, 0) {
+		return mul(mul(pow(u, w), call("ln", u)), dw)
+	}
+	return mul(pow(u, w), add(mul(dw, call("ln", u)), div(mul(w, du), u)))
+}
+
+func callDerivative(n *CallNode, v string, cx *Context) Node {
+	if len(n.Args) == 0 {
+		return num(0)
+	}
+	if fn, ok := cx.Functions[n.Name]; ok && (fn.Funcs > 0 || fn.Lines > 0) {
+		return funcsCallDerivative(n, fn, v, cx)
+	}
+	ds := make([]Node, len(n.Args))
+	allZero := true
+	for i, a := range n.Args {
+		ds[i] = Derivative(a, v, cx)
+		allZero = allZero && isNum(ds[i], 0)
+	}
+	if allZero {
+		return num(0)
+	}
+	if fn, ok := cx.Functions[n.Name]; ok && fn.Expand != nil {
+		if body := fn.Expand(n.Args); body != nil {
+			return Derivative(body, v, cx)
+		}
+	}
+	if len(n.Args) == 1 {
+		if rule, ok := DerivRules[n.Name]; ok {
+			return mul(rule(n.Args[0]), ds[0])
+		}
+	}
+	if fn, ok := cx.Functions[n.Name]; ok && fn.Deriv != "" && !slices.ContainsFunc(ds[1:], func(d Node) bool { return !isNum(d, 0) }) {
+		return mul(call(fn.Deriv, n.Args...), ds[0])
+	}
+	switch n.Name {
+	case "re", "im", "conj":
+		return call(n.Name, ds[0])
+	case "if":
+		return &CallNode{Name: "if", Args: []Node{n.Args[0], ds[1], ds[2]}, Paren: true}
+	case "log":
+		return Derivative(div(call("ln", n.Args[0]), call("ln", n.Args[1])), v, cx)
+	case "pow":
+		return powDerivative(n.Args[0], n.Args[1], ds[0], ds[1])
+	case "mod":
+		if isNum(ds[1], 0) {
+			return ds[0]
+		}
+	case "avg":
+		total := ds[0]
+		for _, d := range ds[1:] {
+			total = add(total, d)
+		}
+		return div(total, num(float64(len(ds))))
+	}
+	return &NumDerivNode{X: n, Var: v}
+}
+
+// funcsCallDerivative returns the derivative of a call to a function with [Function.Funcs] or [Function.Lines],
+// like root(f, a, b) or hits(f). The functions and lines it refers to do not depend on x, so it is 0 with respect
+// to x if none of the other arguments depend on x, and otherwise it is a [NumDerivNode].
+func funcsCallDerivative(n *CallNode, fn *Function, v string, cx *Context) Node {
+	if v == "x" && !slices.ContainsFunc(n.Args[fn.Funcs+fn.Lines:], func(a Node) bool { return !isNum(Derivative(a, v, cx), 0) }) {
+		return num(0)
+	}
+	return &NumDerivNode{X: n, Var: v}
+}
+
+// compileNumDeriv compiles a finite difference derivative
+func compileNumDeriv(n *NumDerivNode, cx *Context) (*Compiled, error) {
+	x, err := CompileNode(n.X, cx)
+	if err != nil {
+		return nil, err
+	}
+	if x.Kind != KindNumber {
+		return nil, compileError(n, "can only take the derivative of a float64 value, not a %v value", x.Kind)
+	}
+	slot := EnvSlot(n.Var, cx)
+	if slot == nil {
+		return nil, compileError(n, "can not take the derivative with respect to %q", n.Var)
+	}
+	f := x.Num
+	return &Compiled{Kind: KindNumber, Num: func(env *Env) float64 {
+		e := env.Clone()
+		s := slot(e)
+		return fd.Derivative(func(v float64) float64 {
+			*s = v
+			return f(e)
+		}, *slot(env), &fd.Settings{
+			Formula: fd.Central,
+		})
+	}}, nil
+}
+
+// EnvSlot returns a function that returns the slot for the variable with the given name
+// in an environment, or nil if the variable does not have a slot. The parameters of helpers
+// are in [Env.Args], so an environment needs to be copied with [Env.Clone] before changing them.
+func EnvSlot(name string, cx *Context) func(env *Env) *float64 {
+	if i := cx.LocalIndex(name); i >= 0 {
+		return func(env *Env) *float64 { return &env.Args[i] }
+	}
+	switch name {
+	case "x":
+		return func(env *Env) *float64 { return &env.X }
+	case "y":
+		return func(env *Env) *float64 { return &env.Y }
+	case "t":
+		return func(env *Env) *float64 { return &env.T }
+	case "h":
+		return func(env *Env) *float64 { return &env.H }
+	case "n":
+		return func(env *Env) *float64 { return &env.N }
+	case "vx":
+		return func(env *Env) *float64 { return &env.VX }
+	case "vy":
+		return func(env *Env) *float64 { return &env.VY }
+	case "age":
+		return func(env *Env) *float64 { return &env.Age }
+	}
+	return nil
+}
+
+// isNum returns whether the node is the given number
+func isNum(n Node, v float64) bool {
+	nn, ok := n.(*NumberNode)
+	return ok && nn.Val == v
+}
+
+// num returns a number node
+func num(v float64) Node {
+	return &NumberNode{Val: v}
+}
+
+// call returns a call node
+func call(name string, args ...Node) Node {
+	return &CallNode{Name: name, Args: args, Paren: true}
+}
+
+// neg returns -x, simplifying constants
+func neg(x Node) Node {
+	if nn, ok := x.(*NumberNode); ok {
+		return num(-nn.Val)
+	}
+	if u, ok := x.(*UnaryNode); ok && u.Op == "-" {
+		return u.X
+	}
+	return &UnaryNode{Op: "-", X: x}
+}
+
+// add returns x+y, simplifying zeros and constants
+func add(x, y Node) Node {
+	switch {
+	case isNum(x, 0):
+		return y
+	case isNum(y, 0):
+		return x
+	}
+	if c, ok := constBinary(x, y, func(a, b float64) float64 { return a + b }); ok {
+		return c
+	}
+	return &BinaryNode{Op: "+", X: x, Y: y}
+}
+
+// sub returns x-y, simplifying zeros and constants
+func sub(x, y Node) Node {
+	switch {
+	case isNum(y, 0):
+		return x
+	case isNum(x, 0):
+		return neg(y)
+	}
+	if c, ok := constBinary(x, y, func(a, b float64) float64 { return a - b }); ok {
+		return c
+	}
+	return &BinaryNode{Op: "-", X: x, Y: y}
+}
+
+// mul returns x*y, simplifying zeros, ones and constants
+func mul(x, y Node) Node {
+	switch {
+	case isNum(x, 0), isNum(y, 0):
+		return num(0)
+	case isNum(x, 1):
+		return y
+	case isNum(y, 1):
+		return x
+	case isNum(x, -1):
+		return neg(y)
+	case isNum(y, -1):
+		return neg(x)
+	}
+	if c, ok := constBinary(x, y, func(a, b float64) float64 { return a * b }); ok {
+		return c
+	}
+	return &BinaryNode{Op: "*", X: x, Y: y}
+}
+
+// div returns x/y, simplifying zeros and ones
+func div(x, y Node) Node {
+	switch {
+	case isNum(x, 0):
+		return num(0)
+	case isNum(y, 1):
+		return x
+	}
+	return &BinaryNode{Op: "/", X: x, Y: y}
+}
+
+// pow returns x^y, simplifying zeros and ones
+func pow(x, y Node) Node {
+	switch {
+	case isNum(y, 0):
+		return num(1)
+	case isNum(y, 1):
+		return x
+	}
+	if c, ok := constBinary(x, y, math.Pow); ok {
+		return c
+	}
+	return &BinaryNode{Op: "^", X: x, Y: y}
+}
+
+// constBinary applies f if x and y are both numbers
+func constBinary(x, y Node, f func(a, b float64) float64) (Node, bool) {
+	xn, ok := x.(*NumberNode)
+	if !ok {
+		return nil, false
+	}
+	yn, ok := y.(*NumberNode)
+	if !ok {
+		return nil, false
+	}
+	return num(f(xn.Val, yn.Val)), true
+}
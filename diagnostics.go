@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Diagnostic is a problem with an expression of the graph, with where it is
+type Diagnostic struct {
+
+	// Line is the index of the line the problem is in, or -1 if it is not in a line
+	Line int
+
+	// Name is the name of the line, variable or helper the problem is in
+	Name string
+
+	// Field is the field the problem is in: Name, Expr, GraphIf or Bounce for lines,
+	// the name of the field for Params (like YForce), or Variable or Helper
+	Field string
+
+	// Pos and End are the rune offsets of the problem in the expression,
+	// or -1 if the problem is with the whole expression
+	Pos, End int
+
+	// Msg is the message describing the problem
+	Msg string
+}
+
+// Diagnostics is a collection of diagnostics
+type Diagnostics []*Diagnostic
+
+// Has returns whether there is already a diagnostic at the same place as the given one
+func (ds Diagnostics) Has(d *Diagnostic) bool {
+	for _, o := range ds {
+		if o.Line == d.Line && o.Name == d.Name && o.Field == d.Field && o.Pos == d.Pos && o.End == d.End {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDiagnostic returns a diagnostic for the given error at the given source,
+// using the position of the error if it is a [SyntaxError]
+func NewDiagnostic(src Diagnostic, err error) *Diagnostic {
+	d := src
+	var se *SyntaxError
+	if errors.As(err, &se) {
+		d.Pos, d.End, d.Msg = se.Pos, se.End, se.Msg
+	} else {
+		d.Pos, d.End, d.Msg = -1, -1, err.Error()
+	}
+	return &d
+}
+
+// Where returns a description of where the problem is, like line f GraphIf, column 3
+func (d *Diagnostic) Where() string {
+	s := ""
+	switch {
+	case d.Field == "":
+		s = "expression"
+	case d.Line >= 0:
+		name := d.Name
+		if name == "" {
+			name = strconv.Itoa(d.Line + 1)
+		}
+		s = fmt.Sprintf("line %v %v", name, d.Field)
+	case d.Name != "":
+		s = fmt.Sprintf("%v %v", d.Field, d.Name)
+	default:
+		s = d.Field
+	}
+	if d.Pos >= 0 {
+		s += fmt.Sprintf(", column %d", d.Pos+1)
+	}
+	return s
+}
+
+func (d *Diagnostic) Error() string {
+	return d.Where() + ": " + d.Msg
+}
+
+// SetSources sets where each expression of the graph is, so that their diagnostics can say where they are
+func (gr *Graph) SetSources() {
+	for k, ln := range gr.Lines {
+		ln.Expr.Source = Diagnostic{Line: k, Name: ln.Name, Field: "Expr"}
+		ln.GraphIf.Source = Diagnostic{Line: k, Name: ln.Name, Field: "GraphIf"}
+		ln.Bounce.Source = Diagnostic{Line: k, Name: ln.Name, Field: "Bounce"}
+	}
+	names, exprs := gr.Params.ExprFields()
+	for i, ex := range exprs {
+		ex.Source = Diagnostic{Line: -1, Field: names[i]}
+	}
+	for _, v := range gr.Variables {
+		v.Expr.Source = Diagnostic{Line: -1, Name: v.Name, Field: "Variable"}
+	}
+}
+
+// diagMu protects the diagnostics of the expressions and the error of the graph,
+// which are added to by the evaluations that are running
+var diagMu sync.Mutex
+
+// Err returns the error found while evaluating the graph that stopped the marbles, if there is one
+func (gr *Graph) Err() error {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	return gr.State.Error
+}
+
+// clearErr removes the error that stopped the marbles, so that they can run again
+func (gr *Graph) clearErr() {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	gr.State.Error = nil
+}
+
+// UpdateDiagnostics shows the current diagnostics of the graph
+func (gr *Graph) UpdateDiagnostics() {
+	gr.State.NewDiags.Store(false)
+	if gr.Objects.DiagnosticsFrame != nil {
+		gr.Objects.DiagnosticsFrame.Update()
+	}
+}
+
+// Diagnostics returns all of the diagnostics of the graph, in the order of the lines, params, variables and helpers
+func (gr *Graph) Diagnostics() Diagnostics {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	ds := Diagnostics{}
+	for _, ln := range gr.Lines {
+		ds = append(ds, ln.Diags...)
+		ds = append(ds, ln.Expr.Diags...)
+		ds = append(ds, ln.GraphIf.Diags...)
+		ds = append(ds, ln.Bounce.Diags...)
+	}
+	_, exprs := gr.Params.ExprFields()
+	for _, ex := range exprs {
+		ds = append(ds, ex.Diags...)
+	}
+	for _, v := range gr.Variables {
+		ds = append(ds, v.Expr.Diags...)
+	}
+	for _, h := range gr.Helpers {
+		ds = append(ds, h.Diags...)
+	}
+	return ds
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"math"
+
 	"cogentcore.org/core/colors"
 	"cogentcore.org/core/math32"
 	"cogentcore.org/core/paint"
@@ -8,19 +10,36 @@ import (
 
 // draw renders the graph.
 func (gr *Graph) draw(pc *paint.Context) {
-	TheGraph.EvalMu.Lock()
-	defer TheGraph.EvalMu.Unlock()
-	gr.updateCoords()
+	gr.EvalMu.RLock()
+	defer gr.EvalMu.RUnlock()
+	// the drawing starts the draw stream over, and the marbles can be updated while the lines are drawn
+	env := &Env{State: NewEvalState(NewRand(DrawStream))}
+	gr.StateMu.Lock()
+	env.T = gr.State.Time
+	gr.updateCoords(env)
+	gr.StateMu.Unlock()
 	gr.drawAxes(pc)
+	gr.StateMu.Lock()
 	gr.drawTrackingLines(pc)
-	gr.drawLines(pc)
+	gr.StateMu.Unlock()
+	gr.drawLines(pc, env)
+	gr.StateMu.Lock()
 	gr.drawMarbles(pc)
+	gr.StateMu.Unlock()
+	if !gr.State.Running.Load() && gr.State.NewDiags.Swap(false) {
+		// the diagnostics can not be updated while drawing, so they are updated after it
+		go func() {
+			gr.Objects.Graph.AsyncLock()
+			gr.UpdateDiagnostics()
+			gr.Objects.Graph.AsyncUnlock()
+		}()
+	}
 }
 
-func (gr *Graph) updateCoords() {
-	if !gr.State.Running || gr.Params.CenterX.Changes || gr.Params.CenterY.Changes {
+func (gr *Graph) updateCoords(env *Env) {
+	if !gr.State.Running.Load() || gr.Params.CenterX.Changes || gr.Params.CenterY.Changes {
 		sizeFromCenter := math32.Vector2{X: GraphViewBoxSize, Y: GraphViewBoxSize}
-		center := math32.Vector2{X: float32(gr.Params.CenterX.Eval(0, 0)), Y: float32(gr.Params.CenterY.Eval(0, 0))}
+		center := math32.Vector2{X: float32(gr.Params.CenterX.Eval(env)), Y: float32(gr.Params.CenterY.Eval(env))}
 		gr.Vectors.Min = center.Sub(sizeFromCenter)
 		gr.Vectors.Max = center.Add(sizeFromCenter)
 		gr.Vectors.Size = sizeFromCenter.MulScalar(2)
@@ -69,27 +88,32 @@ func (gr *Graph) drawTrackingLines(pc *paint.Context) {
 	}
 }
 
-func (gr *Graph) drawLines(pc *paint.Context) {
+func (gr *Graph) drawLines(pc *paint.Context, env *Env) {
 	for _, ln := range gr.Lines {
 		// TODO: this logic doesn't work
 		// If the line doesn't change over time then we don't need to keep graphing it while running marbles
 		// if !ln.Changes && gr.State.Running && !gr.Params.CenterX.Changes && !gr.Params.CenterY.Changes {
 		// 	continue
 		// }
-		ln.draw(gr, pc)
+		ln.draw(gr, pc, env)
 	}
 }
 
-func (ln *Line) draw(gr *Graph, pc *paint.Context) {
+func (ln *Line) draw(gr *Graph, pc *paint.Context, env *Env) {
 	start := true
 	skipped := false
 	for x := TheGraph.Vectors.Min.X; x < TheGraph.Vectors.Max.X; x += TheGraph.Vectors.Inc.X {
-		if TheGraph.State.Error != nil {
+		if gr.Err() != nil {
 			return
 		}
-		fx := float64(x)
-		y := ln.Expr.Eval(fx, TheGraph.State.Time, ln.TimesHit)
-		GraphIf := ln.GraphIf.EvalBool(fx, y, TheGraph.State.Time, ln.TimesHit)
+		e := ln.Env(env, float64(x))
+		y := ln.Expr.EvalEnv(e)
+		if math.IsNaN(y) { // gaps in piecewise lines are not drawn
+			skipped = true
+			continue
+		}
+		e.Y = y
+		GraphIf := ln.GraphIf.EvalBoolEnv(e)
 		if GraphIf && TheGraph.Vectors.Min.Y < float32(y) && TheGraph.Vectors.Max.Y > float32(y) {
 			coord := gr.canvasCoord(math32.Vec2(x, float32(y)))
 			if start || skipped {
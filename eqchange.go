@@ -1,13 +1,8 @@
 package main
 
 import (
-	"cmp"
-	"fmt"
-	"slices"
-	"strconv"
 	"strings"
-
-	"github.com/Knetic/govaluate"
+	"unicode"
 )
 
 // EquationChange type has the string that needs to be replaced and what to replace it with
@@ -16,15 +11,13 @@ type EquationChange struct {
 	New string
 }
 
-// UnreadableChangeSlice is all of the strings that should change before compiling, but the user shouldn't see
+// UnreadableChangeSlice is all of the unicode symbols that stand for names when parsing, but the user shouldn't see replaced
 var UnreadableChangeSlice = []EquationChange{
-	{"^", "**"},
 	{"√", "sqrt"},
-	{"∞", "inf()"},
+	{"∞", "inf"},
 	{"∫", "int"},
 	{"∏", "psum"},
 	{"Σ", "sum"},
-	{")(", ")*("},
 }
 
 // EquationChangeSlice is all of the strings that should be changed
@@ -40,112 +33,39 @@ var EquationChangeSlice = []EquationChange{
 	{`\`, ""},
 }
 
-// ZeroArgFunctions are the functions that do not take any arguments.
-var ZeroArgFunctions = []string{"rand", "nmarbles", "inf"}
-
-// PrepareExpr prepares an expression by looping both equation change slices
-func (ex *Expr) PrepareExpr(functionsArg map[string]govaluate.ExpressionFunction) (string, map[string]govaluate.ExpressionFunction) {
-	functions := make(map[string]govaluate.ExpressionFunction)
-	for name, function := range functionsArg {
-		functions[name] = function
-	}
-	ex.LoopEquationChangeSlice()
-	params := []string{"π", "e", "x", "a", "t", "h", "y", "n"}
-	symbols := []string{"+", "-", "*", "/", "^", ">", "<", "=", "(", ")"}
-	expr := LoopUnreadableChangeSlice(ex.Expr)
-	expr = strings.ReplaceAll(expr, "true", "(0==0)") // prevent true and false from being interpreted as functions
-	expr = strings.ReplaceAll(expr, "false", "(0!=0)")
-	for _, s := range symbols {
-		expr = strings.ReplaceAll(expr, s+"-", s+" -")
-		expr = strings.ReplaceAll(expr, s+".", s+"0.")
-	}
-	for _, p := range params {
-		expr = strings.ReplaceAll(expr, strings.ToUpper(p), p)
-	}
-	i := 0
-	functionsToDelete := []string{}
-	functionsToAdd := make(map[string]govaluate.ExpressionFunction)
-	// sort functions by length so that functions that contain other functions don't cause problems
-	functionKeys := []string{}
-	for k := range functions {
-		functionKeys = append(functionKeys, k)
-	}
-	slices.SortFunc(functionKeys, func(a, b string) int {
-		return cmp.Compare(len(b), len(a))
-	})
-	isZeroArg := map[string]bool{}
-	for _, name := range functionKeys { // to prevent issues with the equation, all functions are turned into zfunctionindexz. z is just a letter that isn't used in anything else.
-		function := functions[name]
-		newName := fmt.Sprintf("z%vz", i)
-		expr = strings.ReplaceAll(expr, name, newName)
-		functionsToAdd[newName] = function
-		functionsToDelete = append(functionsToDelete, name)
-		isZeroArg[newName] = slices.Contains(ZeroArgFunctions, name)
-		i++
-	}
-	for name, function := range functionsToAdd {
-		functions[name] = function
-	}
-	for _, name := range functionsToDelete {
-		delete(functions, name)
-	}
-	for fname := range functions { // if there is a function name and no parentheses after, put parentheses around the next character, or directly after it if it is a zero-arg function
-		if isZeroArg[fname] {
-			expr = strings.ReplaceAll(expr, fname, fname+"()")
-			expr = strings.ReplaceAll(expr, fname+"()()", fname+"()")
-		}
-		for _, pname := range params {
-			expr = strings.ReplaceAll(expr, fname+pname, fname+"("+pname+")")
-		}
-		for n := 0; n < 10; n++ {
-			ns := strconv.Itoa(n)
-			expr = strings.ReplaceAll(expr, fname+ns, fname+"("+ns+")")
+// LoopEquationChangeSlice loops over the Equation Change slice and makes the replacements.
+// Names like sqrt are only replaced where the expression uses them as a name of their own,
+// so that names that contain them, like spin, are kept.
+func (ex *Expr) LoopEquationChangeSlice() {
+	for _, d := range EquationChangeSlice {
+		if !isName(d.Old) {
+			ex.Expr = strings.ReplaceAll(ex.Expr, d.Old, d.New)
 		}
 	}
-	for n := 0; n < 10; n++ { // if the expression contains a number and then a parameter or a function right after, then change it to multiply the number and the parameter/function. Also ()number changes to ()*number
-		ns := strconv.Itoa(n)
-		for _, pname := range params {
-			expr = strings.ReplaceAll(expr, ns+pname, ns+"*"+pname)
-			expr = strings.ReplaceAll(expr, ns+"("+pname, ns+"*("+pname)
-		}
-		for fname := range functions {
-			expr = strings.ReplaceAll(expr, ns+fname, ns+"*"+fname)
-			expr = strings.ReplaceAll(expr, ns+"("+fname, ns+"*("+fname)
-		}
-		expr = strings.ReplaceAll(expr, ")"+ns, ")*"+ns)
+	toks, err := Lex(ex.Expr, TheGraph.Context().Scope())
+	if err != nil {
+		return
 	}
-	for _, pname := range params { // if the expression contains a parameter before another parameter or a function, make it multiply. Also ()parameter changes to ()*parameter
-		for _, pname1 := range params {
-			for strings.Contains(expr, pname+pname1) || strings.Contains(expr, pname+"("+pname1) {
-				expr = strings.ReplaceAll(expr, pname+pname1, pname+"*"+pname1)
-				expr = strings.ReplaceAll(expr, pname+"("+pname1, pname+"*("+pname1)
-			}
+	src := []rune(ex.Expr)
+	res := []rune{}
+	last := 0
+	for _, t := range toks {
+		if t.Kind != TokenName {
+			continue
 		}
-		for fname := range functions {
-			expr = strings.ReplaceAll(expr, pname+fname, pname+"*"+fname)
-			expr = strings.ReplaceAll(expr, pname+"("+fname, pname+"*("+fname)
+		text := string(src[t.Pos:t.End])
+		for _, d := range EquationChangeSlice {
+			if d.Old == text {
+				res = append(append(res, src[last:t.Pos]...), []rune(d.New)...)
+				last = t.End
+				break
+			}
 		}
-		expr = strings.ReplaceAll(expr, ")"+pname, ")*"+pname)
-		expr = strings.ReplaceAll(expr, pname+"(", pname+"*(")
-	}
-	for fname := range functions { // replace ()fname() with ()*fname()
-		expr = strings.ReplaceAll(expr, ")"+fname, ")*"+fname)
-	}
-
-	return expr, functions
-}
-
-// LoopEquationChangeSlice loops over the Equation Change slice and makes the replacements
-func (ex *Expr) LoopEquationChangeSlice() {
-	for _, d := range EquationChangeSlice {
-		ex.Expr = strings.ReplaceAll(ex.Expr, d.Old, d.New)
 	}
+	ex.Expr = string(append(res, src[last:]...))
 }
 
-// LoopUnreadableChangeSlice loops over the unreadable Change slice and makes the replacements
-func LoopUnreadableChangeSlice(expr string) string {
-	for _, d := range UnreadableChangeSlice {
-		expr = strings.ReplaceAll(expr, d.Old, d.New)
-	}
-	return expr
+// isName returns whether the given text is a name made of letters
+func isName(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
 }
@@ -2,10 +2,8 @@ package main
 
 import (
 	"fmt"
-	"math"
 
-	"github.com/Knetic/govaluate"
-	"gonum.org/v1/gonum/integrate"
+	"gonum.org/v1/gonum/spatial/r2"
 )
 
 // Expr is an expression
@@ -13,102 +11,169 @@ type Expr struct {
 	// Equation: use x for the x value, t for the time passed since the marbles were ran (incremented by TimeStep), and a for 10*sin(t) (swinging back and forth version of t)
 	Expr string `width:"30" label:""`
 
-	Val *govaluate.EvaluableExpression `display:"-" json:"-"`
+	Val *Compiled `display:"-" json:"-"`
 
-	Params map[string]any `display:"-" json:"-"`
+	// Node is the syntax tree of the expression
+	Node Node `display:"-" json:"-"`
+
+	// Source is where the expression is, which is used for its diagnostics
+	Source Diagnostic `display:"-" json:"-"`
+
+	// Diags are the problems with the expression from compiling and evaluating it
+	Diags Diagnostics `display:"-" json:"-"`
 }
 
-// Integrate returns the integral of an expression
-func (ex *Expr) Integrate(min, max float64, h int) float64 {
-	var vals []float64
-	sign := float64(1)
-	diff := max - min
-	if diff == 0 {
-		return 0
-	}
-	if diff < 0 {
-		diff = -diff
-		sign = -1
-		min, max = max, min
+// Integrate returns the integral of an expression with respect to x from min to max in the given environment
+func (ex *Expr) Integrate(env *Env, min, max float64) float64 {
+	e := *env
+	e.state()
+	return IntegrateFunc(func(x float64) float64 {
+		e.X = x
+		return ex.EvalEnv(&e)
+	}, min, max)
+}
+
+// Compile gets an expression ready for evaluation.
+func (ex *Expr) Compile() error {
+	if err := ex.Parse(); err != nil {
+		return err
 	}
-	accuracy := 16
-	dx := diff / float64(accuracy)
-	for x := min; x <= max; x += dx {
-		vals = append(vals, ex.Eval(x, TheGraph.State.Time, h))
+	return ex.CompileParsed()
+}
+
+// Parse parses the expression into [Expr.Node], removing what was compiled from it before
+func (ex *Expr) Parse() error {
+	ex.Val = nil
+	ex.Node = nil
+	ex.Diags = nil
+	if ex.Expr == "" {
+		return nil
 	}
-	if len(vals) != accuracy+1 {
-		vals = append(vals, ex.Eval(max, TheGraph.State.Time, h))
+	ex.LoopEquationChangeSlice()
+	node, err := ParseExpr(ex.Expr, TheGraph.Context().Scope())
+	if err != nil {
+		ex.Report(err)
+		return err
 	}
-	val := integrate.Romberg(vals, dx)
-	return sign * val
+	ex.Node = node
+	return nil
 }
 
-// Compile gets an expression ready for evaluation.
-func (ex *Expr) Compile() error {
-	expr, functions := ex.PrepareExpr(TheGraph.Functions)
-	var err error
-	ex.Val, err = govaluate.NewEvaluableExpressionWithFunctions(expr, functions)
-	if HandleError(err) {
-		ex.Val = nil
+// CompileParsed compiles the syntax tree from [Expr.Parse], if there is one
+func (ex *Expr) CompileParsed() error {
+	memoGen++
+	if ex.Node == nil {
+		return nil
+	}
+	cx := TheGraph.Context()
+	cx.Warn = ex.Warn
+	val, err := CompileNode(ex.Node, cx)
+	if err != nil {
+		ex.Report(err)
 		return err
 	}
-	if ex.Params == nil {
-		ex.Params = make(map[string]any, 2)
+	ex.Val = val
+	return nil
+}
+
+// Report adds a diagnostic for the given error to the expression
+func (ex *Expr) Report(err error) {
+	ex.Diags = append(ex.Diags, NewDiagnostic(ex.Source, err))
+}
+
+// Warn adds a diagnostic for a problem found while evaluating the expression that does not stop the marbles,
+// unless it already has one there
+func (ex *Expr) Warn(err error) {
+	d := NewDiagnostic(ex.Source, err)
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	if !ex.Diags.Has(d) {
+		ex.Diags = append(ex.Diags, d)
+		TheGraph.State.NewDiags.Store(true)
 	}
-	ex.Params["π"] = math.Pi
-	ex.Params["e"] = math.E
-	return err
+}
+
+// CheckKind reports an error and removes the compiled expression
+// if it is not of the given kind, like a GraphIf that is not a bool value
+// A complex value can be used where a number is needed as long as it is real when evaluated.
+func (ex *Expr) CheckKind(kind Kind) {
+	if ex.Val == nil || ex.Val.Kind == kind || (ex.Val.Kind == KindComplex && kind == KindNumber) {
+		return
+	}
+	ex.Report(compileError(ex.Node, "it is a %v value, should be a %v value", ex.Val.Kind, kind))
+	ex.Val = nil
+}
+
+// runtimeError reports an error found while evaluating the expression, which stops the marbles.
+// Only the first one is reported until the graph is compiled again, since the expression is
+// still evaluated by the other evaluations that are running.
+func (ex *Expr) runtimeError(err error) {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	if TheGraph.State.Error != nil {
+		return
+	}
+	d := NewDiagnostic(ex.Source, err)
+	ex.Diags = append(ex.Diags, d)
+	TheGraph.State.Error = d
+	TheGraph.Stop()
 }
 
 // Eval corees the y value of the function for given x, t and h value
 func (ex *Expr) Eval(x, t float64, h int) float64 {
-	if ex.Expr == "" {
+	return ex.EvalEnv(&Env{X: x, T: t, H: float64(h)})
+}
+
+// EvalWithY calls eval but with a y value set
+func (ex *Expr) EvalWithY(x, t float64, h int, y float64) float64 {
+	return ex.EvalEnv(&Env{X: x, Y: y, T: t, H: float64(h)})
+}
+
+// EvalEnv evaluates the expression as a number in the given environment
+func (ex *Expr) EvalEnv(env *Env) float64 {
+	if ex.Expr == "" || ex.Val == nil {
 		return 0
 	}
-	ex.Params["x"] = x
-	ex.Params["t"] = t
-	ex.Params["a"] = 10 * math.Sin(t)
-	ex.Params["h"] = h
-	yi, err := ex.Val.Evaluate(ex.Params)
-	if HandleError(err) {
-		return 0
+	if ex.Val.Kind == KindComplex {
+		z := ex.Val.Cplx(env)
+		v, ok := realValue(z)
+		if !ok {
+			ex.runtimeError(compileError(ex.Node, "the value %v at x = %v is not real; use re, im or abs to get a real value", z, env.X))
+		}
+		return v
 	}
-	switch y := yi.(type) {
-	case float64:
-		return y
-	default:
-		TheGraph.Stop()
-		HandleError(fmt.Errorf("expression %v is invalid, it is a %T value, should be a float64 value", ex.Expr, yi))
+	if ex.Val.Kind != KindNumber {
+		ex.runtimeError(fmt.Errorf("expression %v is invalid, it is a %v value, should be a float64 value", ex.Expr, ex.Val.Kind))
 		return 0
 	}
+	return ex.Val.Num(env)
 }
 
-// EvalWithY calls eval but with a y value set
-func (ex *Expr) EvalWithY(x, t float64, h int, y float64) float64 {
-	ex.Params["y"] = y
-	return ex.Eval(x, t, h)
+// EvalPoint evaluates the expression as a point in the given environment
+func (ex *Expr) EvalPoint(env *Env) r2.Vec {
+	if ex.Expr == "" || ex.Val == nil {
+		return r2.Vec{}
+	}
+	if ex.Val.Kind != KindPoint {
+		ex.runtimeError(fmt.Errorf("expression %v is invalid, it is a %v value, should be a point value", ex.Expr, ex.Val.Kind))
+		return r2.Vec{}
+	}
+	return ex.Val.Pt(env)
 }
 
 // EvalBool checks if a statement is true based on the x, y, t and h values
 func (ex *Expr) EvalBool(x, y, t float64, h int) bool {
-	if ex.Expr == "" {
-		return true
-	}
-	ex.Params["x"] = x
-	ex.Params["t"] = t
-	ex.Params["a"] = 10 * math.Sin(t)
-	ex.Params["h"] = h
-	ex.Params["y"] = y
-	ri, err := ex.Val.Evaluate(ex.Params)
-	if HandleError(err) {
+	return ex.EvalBoolEnv(&Env{X: x, Y: y, T: t, H: float64(h)})
+}
+
+// EvalBoolEnv evaluates the expression as a bool in the given environment
+func (ex *Expr) EvalBoolEnv(env *Env) bool {
+	if ex.Expr == "" || ex.Val == nil {
 		return true
 	}
-	switch r := ri.(type) {
-	case bool:
-		return r
-	default:
-		TheGraph.Stop()
-		HandleError(fmt.Errorf("expression %v is invalid, it is a %T value, should be a bool value", ex.Expr, ri))
+	if ex.Val.Kind != KindBool {
+		ex.runtimeError(fmt.Errorf("expression %v is invalid, it is a %v value, should be a bool value", ex.Expr, ex.Val.Kind))
 		return false
 	}
+	return ex.Val.Bool(env)
 }
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"cogentcore.org/core/core"
+	"cogentcore.org/core/math32"
+	"github.com/Knetic/govaluate"
+	"gonum.org/v1/gonum/diff/fd"
+)
+
+var benchExprs = []string{"sinx+4", "(x-a)^2/30", "-absx/2-3", "abs(x+a)%2>0.5", "if(x>0, -x^2, √(7^2-x^2))"}
+
+// govaluateExpr compiles an expression the way it was compiled before [CompileNode]
+func govaluateExpr(tb testing.TB, s string) *govaluate.EvaluableExpression {
+	ex := Expr{Expr: s}
+	expr, functions, err := ex.PrepareExpr(TheGraph.Functions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	val, err := govaluate.NewEvaluableExpressionWithFunctions(expr, functions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return val
+}
+
+// govaluateParams sets the parameters the way [Expr.Eval] did before [Env]
+func govaluateParams(params map[string]any, x, t float64, h int) {
+	params["π"] = math.Pi
+	params["e"] = math.E
+	params["x"] = x
+	params["t"] = t
+	params["a"] = 10 * math.Sin(t)
+	params["h"] = h
+}
+
+// PrepareExpr parses an expression and turns it into an expression that govaluate can evaluate,
+// along with the functions it uses under the names they have in that expression.
+// Expressions are compiled with [CompileNode] instead; this is kept for comparing against govaluate.
+func (ex *Expr) PrepareExpr(functionsArg Functions) (string, map[string]govaluate.ExpressionFunction, error) {
+	ex.LoopEquationChangeSlice()
+	node, err := ParseExpr(ex.Expr, (&Context{Functions: functionsArg}).Scope())
+	if err != nil {
+		return "", nil, err
+	}
+	// function names can contain characters like ' and " that govaluate does not accept,
+	// so all functions are turned into zfunctionindexz. z is just a letter that isn't used in anything else.
+	names := map[string]string{}
+	functions := make(map[string]govaluate.ExpressionFunction)
+	Walk(node, func(n Node) bool {
+		if c, ok := n.(*CallNode); ok && c.Name != "if" {
+			if _, has := names[c.Name]; !has {
+				newName := fmt.Sprintf("z%vz", len(names))
+				names[c.Name] = newName
+				functions[newName] = functionsArg[c.Name].ExpressionFunction()
+			}
+		}
+		return true
+	})
+	return govaluateString(node, names), functions, nil
+}
+
+// govaluateString returns the node as text that govaluate can parse, using the given new function names
+func govaluateString(n Node, names map[string]string) string {
+	switch n := n.(type) {
+	case *UnaryNode:
+		return "(" + n.Op + govaluateString(n.X, names) + ")"
+	case *BinaryNode:
+		op := n.Op
+		if op == "^" {
+			op = "**"
+		}
+		return "(" + govaluateString(n.X, names) + " " + op + " " + govaluateString(n.Y, names) + ")"
+	case *ParenNode:
+		return govaluateString(n.X, names)
+	case *CallNode:
+		if n.Name == "if" {
+			return "(" + govaluateString(n.Args[0], names) + " ? " + govaluateString(n.Args[1], names) + " : " + govaluateString(n.Args[2], names) + ")"
+		}
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = govaluateString(a, names)
+		}
+		return names[n.Name] + "(" + strings.Join(args, ", ") + ")"
+	}
+	return n.String()
+}
+
+// ExpressionFunction returns the function as a govaluate function, for comparing against govaluate evaluation.
+func (fn *Function) ExpressionFunction() govaluate.ExpressionFunction {
+	return func(args ...any) (any, error) {
+		if fn.NArgs >= 0 && len(args) != fn.NArgs {
+			return nil, fmt.Errorf("evaluation error: function wants %v arguments, not %v arguments", fn.NArgs, len(args))
+		}
+		vals := make([]float64, len(args))
+		for i, arg := range args {
+			v, ok := arg.(float64)
+			if !ok {
+				return nil, fmt.Errorf("evaluation error: function does not accept input type %T for argument %v", arg, i)
+			}
+			vals[i] = v
+		}
+		if fn.Call == nil {
+			return fn.Call1(&Env{}, vals[0]), nil
+		}
+		return fn.Call(&Env{}, vals), nil
+	}
+}
+
+func TestEvalMatchesGovaluate(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	params := map[string]any{}
+	for _, s := range benchExprs {
+		ex := Expr{Expr: s}
+		if err := ex.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		val := govaluateExpr(t, s)
+		for x := -5.0; x <= 5; x += 0.25 {
+			govaluateParams(params, x, 1.5, 2)
+			want, err := val.Evaluate(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have any
+			if ex.Val.Kind == KindBool {
+				have = ex.EvalBool(x, 0, 1.5, 2)
+			} else {
+				have = ex.Eval(x, 1.5, 2)
+			}
+			if wf, ok := want.(float64); ok && math.IsNaN(wf) {
+				if !math.IsNaN(have.(float64)) {
+					t.Errorf("%s at x=%v: expected NaN but got %v", s, x, have)
+				}
+				continue
+			}
+			if have != want {
+				t.Errorf("%s at x=%v: expected %v but got %v", s, x, want, have)
+			}
+		}
+	}
+}
+
+// callExpr calls functions with more than one argument, including a helper that calls one
+const callExpr = "max(x, a, 1) + min(x, 2) + bump(x, 1, 2)"
+
+func BenchmarkEval(b *testing.B) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	addBumpHelper(b)
+	defer func() { TheGraph.Helpers = nil }()
+	for _, s := range append(benchExprs, callExpr) {
+		ex := Expr{Expr: s}
+		if err := ex.Compile(); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(s, func(b *testing.B) {
+			b.ReportAllocs()
+			env := &Env{T: 1.5, H: 2}
+			for i := 0; i < b.N; i++ {
+				env.X = float64(i%100) / 10
+				if ex.Val.Kind == KindBool {
+					ex.Val.Bool(env)
+				} else {
+					ex.Val.Num(env)
+				}
+			}
+		})
+	}
+}
+
+// addBumpHelper adds the helper bump(x, c, w) = exp(-((x-c)/w)^2) to the graph functions
+func addBumpHelper(tb testing.TB) {
+	TheGraph.Variables = nil
+	TheGraph.Helpers = Helpers{{Def: "bump(x, c, w) = exp(-((x-c)/w)^2)"}}
+	TheGraph.ParseHelpers()
+	TheGraph.AddHelperFunctions()
+	TheGraph.ParseHelperBodies()
+	if err := TheGraph.CompileHelpers(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// TestEvalAllocs checks that evaluating calls does not allocate their arguments
+func TestEvalAllocs(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	addBumpHelper(t)
+	defer func() { TheGraph.Helpers = nil }()
+	ex := Expr{Expr: callExpr}
+	if err := ex.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	env := &Env{X: 0.5, T: 1.5}
+	want := ex.Val.Num(env)
+	if allocs := testing.AllocsPerRun(100, func() { ex.Val.Num(env) }); allocs > 0 {
+		t.Errorf("expected no allocations but got %v", allocs)
+	}
+	if have := ex.Val.Num(env); have != want || len(env.State.args) != 0 {
+		t.Errorf("expected %v with an empty argument stack but got %v with %v", want, have, env.State.args)
+	}
+}
+
+func BenchmarkEvalGovaluate(b *testing.B) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	for _, s := range benchExprs {
+		val := govaluateExpr(b, s)
+		b.Run(s, func(b *testing.B) {
+			params := map[string]any{}
+			for i := 0; i < b.N; i++ {
+				govaluateParams(params, float64(i%100)/10, 1.5, 2)
+				val.Evaluate(params)
+			}
+		})
+	}
+}
+
+// newTestLine returns a line with the given name and expression and the default GraphIf and Bounce
+func newTestLine(name, expr string) *Line {
+	ln := &Line{Name: name}
+	ln.Defaults(0)
+	ln.Expr.Expr = expr
+	return ln
+}
+
+// TestEvalConcurrent evaluates the same compiled expressions in parallel while the marbles are updated,
+// which should be run with -race. Every evaluation with a new draw state gets the same values.
+func TestEvalConcurrent(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	gr.Params.Defaults()
+	gr.Params.NMarbles = 50
+	gr.Params.MarbleStartY.Expr = "1" // just above f, so that the marbles hit it
+	gr.Lines = Lines{
+		newTestLine("f", "sin(x+t)/2 + u(6)/100"),
+		newTestLine("g", "F(x)/10 + f'(x) - 5"),
+		newTestLine("k", "fint(0, 1) + perlin(x, t) + argmin(f, -2, 2) + rand/10 + randn(0, 1)/10 - 8"),
+	}
+	gr.Helpers = Helpers{{Def: "u(0) = 1"}, {Def: "u(n) = u(n-1)/2 + n"}}
+	gr.Variables = nil
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.ParseHelpers()
+	gr.AddLineFunctions()
+	gr.AddHelperFunctions()
+	gr.CompileExprs()
+	if ds := gr.Diagnostics(); len(ds) > 0 {
+		t.Fatal(ds)
+	}
+	gr.Vectors.Min = math32.Vector2{X: -GraphViewBoxSize, Y: -GraphViewBoxSize}
+	gr.Vectors.Max = math32.Vector2{X: GraphViewBoxSize, Y: GraphViewBoxSize}
+	gr.Vectors.Size = gr.Vectors.Max.Sub(gr.Vectors.Min)
+	gr.InitMarbles()
+
+	// eval evaluates all of the lines like they are drawn at time 1
+	eval := func() []float64 {
+		gr.EvalMu.RLock()
+		defer gr.EvalMu.RUnlock()
+		env := &Env{T: 1, State: NewEvalState(NewRand(DrawStream))}
+		vals := []float64{}
+		for _, ln := range gr.Lines {
+			for x := -5.0; x <= 5; x += 0.5 {
+				vals = append(vals, ln.Expr.EvalEnv(ln.Env(env, x)))
+			}
+		}
+		return vals
+	}
+	want := eval()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			gr.UpdateMarblesData()
+			gr.AdvanceTime()
+		}
+	}()
+	res := make([][]float64, 4)
+	for i := range res {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res[i] = eval()
+		}()
+	}
+	wg.Wait()
+	for _, have := range res {
+		if !slices.Equal(have, want) {
+			t.Errorf("expected %v but got %v", want, have)
+		}
+	}
+
+	// a runtime error stops the marbles from whichever evaluation finds it, while the marbles
+	// and the drawing check for it and the graph is compiled again
+	gr.Objects.Graph = &core.Canvas{}
+	defer func() { gr.Objects.Graph = nil }()
+	gr.Lines[2].Expr.Expr = "i*t - 8"
+	for range 3 {
+		gr.State.Running.Store(true)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for gr.State.Running.Load() && gr.Err() == nil {
+				gr.UpdateMarblesData()
+				gr.AdvanceTime()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if !gr.State.Running.Load() && gr.Err() != nil {
+					return
+				}
+				eval()
+			}
+		}()
+		gr.Graph()
+		wg.Wait()
+	}
+	gr.Graph()
+	gr.State.Running.Store(true)
+	eval()
+	if gr.State.Running.Load() || gr.Err() == nil {
+		t.Errorf("expected the error to stop the marbles, but running is %v and the error is %v", gr.State.Running.Load(), gr.Err())
+	}
+
+	// opening and resetting the graph replace what is evaluated while it is still drawn
+	done, started := make(chan bool), make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				eval()
+				gr.UpdateMarblesData()
+			}
+		}
+	}()
+	<-started
+	for range 5 {
+		for _, file := range []string{"graphs/maze.json", "graphs/tug-of-war.json"} {
+			if err := gr.OpenJSON(core.Filename(file)); err != nil {
+				t.Error(err)
+			}
+			gr.Reset()
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestCrowdCount checks the counts of the grid of the crowd against comparing every position with the box
+func TestCrowdCount(t *testing.T) {
+	r := NewRand(1)
+	inf, nan := float32(math.Inf(1)), float32(math.NaN())
+	crowds := [][]math32.Vector2{nil, {{X: 1, Y: 1}, {X: 1, Y: 1}}, {{X: nan, Y: 0}, {X: inf, Y: 2}, {X: 0, Y: -inf}}}
+	for _, n := range []int{10, 1000, 5000} {
+		ps := make([]math32.Vector2, n)
+		for i := range ps {
+			ps[i] = math32.Vector2{X: float32(r.NormFloat64() * 5), Y: float32(r.Float64()*20 - 10)}
+		}
+		ps[0].X = nan
+		crowds = append(crowds, ps)
+	}
+	boxes := [][4]float64{{-10, -10, 10, 10}, {0, 0, 0, 0}, {1, 1, 1, 1}, {20, 20, 30, 30}, {math.Inf(-1), math.Inf(-1), math.Inf(1), math.Inf(1)}, {0, math.NaN(), 1, 1}}
+	for range 200 {
+		boxes = append(boxes, [4]float64{r.Float64()*30 - 15, r.Float64()*30 - 15, r.Float64()*30 - 15, r.Float64()*30 - 15})
+	}
+	for _, ps := range crowds {
+		c := &Crowd{Pos: ps}
+		c.grid.init(ps)
+		for _, b := range boxes {
+			x1, x2 := min(b[0], b[2]), max(b[0], b[2])
+			y1, y2 := min(b[1], b[3]), max(b[1], b[3])
+			want := 0
+			for _, p := range ps {
+				x, y := float64(p.X), float64(p.Y)
+				if x >= x1 && x <= x2 && y >= y1 && y <= y2 {
+					want++
+				}
+			}
+			if have := c.Count(b[0], b[1], b[2], b[3]); have != float64(want) {
+				t.Errorf("%v marbles in %v: expected %v but got %v", len(ps), b, want, have)
+			}
+		}
+	}
+}
+
+// TestCrowdOrder checks that a gate that closes once 5 marbles are below it does not depend on
+// the order that the marbles are updated in
+func TestCrowdOrder(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	run := func(reverse bool) map[int]math32.Vector2 {
+		gr.Params.Defaults()
+		gr.Params.NMarbles = 30
+		gr.Params.MarbleStartY.Expr = "2 + n/3"
+		gr.Lines = Lines{newTestLine("f", "-8"), newTestLine("g", "0")}
+		gr.Lines[1].GraphIf.Expr = "count(-10, -10, 10, 0) >= 5"
+		gr.Helpers, gr.Variables = nil, nil
+		gr.SetFunctionsTo(DefaultFunctions)
+		gr.AddLineFunctions()
+		gr.CompileExprs()
+		if ds := gr.Diagnostics(); len(ds) > 0 {
+			t.Fatal(ds)
+		}
+		gr.Vectors.Min = math32.Vector2{X: -GraphViewBoxSize, Y: -GraphViewBoxSize}
+		gr.Vectors.Max = math32.Vector2{X: GraphViewBoxSize, Y: GraphViewBoxSize}
+		gr.Vectors.Size = gr.Vectors.Max.Sub(gr.Vectors.Min)
+		gr.InitMarbles()
+		if reverse {
+			slices.Reverse(gr.Marbles)
+		}
+		for range 200 {
+			gr.UpdateMarblesData()
+			gr.AdvanceTime()
+		}
+		if n := gr.Crowd().Count(-10, -10, 10, 0); n != 5 {
+			t.Errorf("expected 5 marbles below the gate but got %v", n)
+		}
+		pos := map[int]math32.Vector2{}
+		for _, m := range gr.Marbles {
+			pos[m.Index] = m.Pos
+		}
+		return pos
+	}
+	want, have := run(false), run(true)
+	for n, p := range want {
+		if have[n] != p {
+			t.Errorf("expected marble %v at %v but got %v", n, p, have[n])
+		}
+	}
+}
+
+func TestHitLog(t *testing.T) {
+	hl := HitLog{}
+	if n, last := hl.Since(0), hl.Last(); n != 0 || !math.IsNaN(last) {
+		t.Errorf("expected no hits but got %v hits with the last at %v", n, last)
+	}
+	for _, tm := range []float64{0.5, 1, 1, 2, 3, 3, 3} {
+		hl.Add(tm)
+	}
+	for _, c := range []struct {
+		t    float64
+		want int64
+	}{{0, 7}, {0.5, 6}, {1, 4}, {2.5, 3}, {3, 0}} {
+		if have := hl.Since(c.t); have != c.want {
+			t.Errorf("expected %v hits since %v but got %v", c.want, c.t, have)
+		}
+	}
+	if last := hl.Last(); last != 3 {
+		t.Errorf("expected the last hit at 3 but got %v", last)
+	}
+	for i := range maxHitLog {
+		hl.Add(float64(4 + i))
+	}
+	if len(hl.times) > maxHitLog {
+		t.Errorf("expected at most %v times but got %v", maxHitLog, len(hl.times))
+	}
+	if n, all := hl.Since(maxHitLog-7), hl.Since(0); n != 10 || all != maxHitLog+7 {
+		t.Errorf("expected 10 recent hits and %v in all but got %v and %v", maxHitLog+7, n, all)
+	}
+}
+
+// TestDerivRules checks each rule in [DerivRules] against central differences
+func TestDerivRules(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	TheGraph.Variables = nil
+	cx := TheGraph.Context()
+	for name := range DerivRules {
+		// the inner expression keeps the argument in the domain of the function and away from its jumps
+		inner := "0.5 + 0.3x"
+		switch name {
+		case "arccosh", "arcsec", "arccsc", "arccoth":
+			inner = "1.5 + 0.3x"
+		}
+		u, err := ParseExpr(inner, cx.Scope())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := CompileNode(call(name, u), cx)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		d, err := CompileNode(Derivative(call(name, u), "x", cx), cx)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for _, x := range []float64{0.37, 0.81} {
+			want := fd.Derivative(func(x float64) float64 { return f.Num(&Env{X: x}) }, x, &fd.Settings{Formula: fd.Central})
+			have := d.Num(&Env{X: x})
+			if math.Abs(have-want) > 1e-5*max(1, math.Abs(want)) {
+				t.Errorf("%v(%v) at x=%v: expected a derivative of %v but got %v", name, inner, x, want, have)
+			}
+		}
+	}
+}
+
+// TestFormatRoundTrip checks that formatted text parses to an expression that formats the same and has the same values
+func TestFormatRoundTrip(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	TheGraph.Variables = nil
+	cx := TheGraph.Context()
+	exprs := []string{
+		"2x^2 - 3x + 1", "sin(x)/2", "-x^2", "2*(-x)", "2*(-3)", "(-x)^2", "2^3^x", "(2^3)^x", "x-(1-x)", "x/(2/x)",
+		"sqrt(x+1)", "cbrt(x)", "abs(x-1)", "(x+1)(x-1)", "x%3", "e^x", "πx", "sin(x)^2 + cos(x)^2",
+		"sum(k, 1, 5, k*x)", "prod(k, 1, 3, x+k)", "int(sin(t)*x, t, 0, 1)", "if(x > 0, x, -x)",
+		"x > 0 && x < 2 || x == 5", "!(x > 1)", "max(x, 1, 2)", "clamp(x, -1, 1)", "inf", "2rand*0",
+	}
+	for _, s := range exprs {
+		n, err := ParseExpr(s, cx.Scope())
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		text := FormatNode(n, FormatText)
+		rn, err := ParseExpr(text, cx.Scope())
+		if err != nil {
+			t.Errorf("%s: can not parse %q again: %v", s, text, err)
+			continue
+		}
+		if again := FormatNode(rn, FormatText); again != text {
+			t.Errorf("%s: expected %q to format the same but got %q", s, text, again)
+		}
+		a, err := CompileNode(n, cx)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		b, err := CompileNode(rn, cx)
+		if err != nil {
+			t.Fatal(text, err)
+		}
+		if a.Kind != b.Kind {
+			t.Errorf("%s: expected a %v value for %q but got a %v value", s, a.Kind, text, b.Kind)
+			continue
+		}
+		for _, x := range []float64{-1.5, 0.5, 2} {
+			env := &Env{X: x}
+			if a.Kind == KindBool {
+				if av, bv := a.Bool(env), b.Bool(env); av != bv {
+					t.Errorf("%s at x=%v: expected %v for %q but got %v", s, x, av, text, bv)
+				}
+				continue
+			}
+			if av, bv := a.Num(env), b.Num(env); av != bv && !(math.IsNaN(av) && math.IsNaN(bv)) {
+				t.Errorf("%s at x=%v: expected %v for %q but got %v", s, x, av, text, bv)
+			}
+		}
+	}
+}
+
+// TestEquationChangeNames checks that names are only replaced with symbols where they are used on their own
+func TestEquationChangeNames(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	TheGraph.Variables = Variables{{Name: "spin", Expr: Expr{Expr: "2"}}}
+	for s, want := range map[string]string{
+		"spin*x":         "spin*x",
+		"2pix + sqrt(x)": "2πx + √(x)",
+		"inf - spin":     "∞ - spin",
+		"x**2":           "x^2",
+	} {
+		ex := Expr{Expr: s}
+		ex.LoopEquationChangeSlice()
+		if ex.Expr != want {
+			t.Errorf("expected %q to change to %q but got %q", s, want, ex.Expr)
+		}
+	}
+	TheGraph.Variables = nil
+}
+
+// TestBinderScope checks that the index of sum is only a variable in its body
+func TestBinderScope(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	TheGraph.Variables = nil
+	TheGraph.Functions["k"] = NewFunc1(func(x float64) float64 { return 100 * x })
+	defer delete(TheGraph.Functions, "k")
+	cx := TheGraph.Context()
+	n, err := ParseExpr("sum(k, 1, 3, kx) + k(x)", cx.Scope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := CompileNode(n, cx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Num(&Env{X: 2}); v != 212 {
+		t.Errorf("expected 212 but got %v", v)
+	}
+}
+
+// TestSequenceUsesX checks that the terms of a sequence that uses x through other helpers and variables are not reused at another x
+func TestSequenceUsesX(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	gr.Lines = Lines{newTestLine("f", "u(3)")}
+	gr.Helpers = Helpers{{Def: "u(0) = 0"}, {Def: "u(n) = u(n-1) + v(n)"}, {Def: "v(n) = w(n)"}, {Def: "w(n) = nk"}}
+	gr.Variables = Variables{{Name: "k", Expr: Expr{Expr: "x"}}}
+	defer func() { gr.Variables = nil }()
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.ParseHelpers()
+	gr.AddLineFunctions()
+	gr.AddHelperFunctions()
+	gr.CompileExprs()
+	if ds := gr.Diagnostics(); len(ds) > 0 {
+		t.Fatal(ds)
+	}
+	env := &Env{State: NewEvalState(NewRand(DrawStream))}
+	ln := gr.Lines[0]
+	for _, x := range []float64{1, 2, 1} {
+		if have := ln.Expr.EvalEnv(ln.Env(env, x)); have != 6*x {
+			t.Errorf("at x=%v: expected %v but got %v", x, 6*x, have)
+		}
+	}
+}
+
+func TestLineDeps(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	f, g := newTestLine("f", "x"), newTestLine("g", "f(x)")
+	f.GraphIf.Expr = "u(x) > 0"
+	g.Bounce.Expr = "k"
+	// p and q call each other, r and j use each other, and so do w and m
+	gr.Lines = Lines{f, g, newTestLine("p", "q(x)"), newTestLine("q", "p(x)"), newTestLine("r", "jx")}
+	gr.Helpers = Helpers{{Def: "u(x) = x + t"}, {Def: "w(x) = mx"}}
+	gr.Variables = Variables{{Name: "k", Expr: Expr{Expr: "t"}}, {Name: "j", Expr: Expr{Expr: "r(1)"}}, {Name: "m", Expr: Expr{Expr: "w(1)"}}}
+	defer func() { gr.Variables, gr.Helpers = nil, nil }()
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.ParseHelpers()
+	gr.AddLineFunctions()
+	gr.AddHelperFunctions()
+	gr.CompileExprs()
+	d := f.Deps()
+	if !slices.Equal(d.Helpers, []string{"u"}) || !f.Changes {
+		t.Errorf("f: expected to use u and change but got %+v and %v", d, f.Changes)
+	}
+	d = g.Deps()
+	if !slices.Equal(d.Lines, []int{0}) || !slices.Equal(d.Variables, []string{"k"}) || !g.Changes {
+		t.Errorf("g: expected to use f and k and change but got %+v and %v", d, g.Changes)
+	}
+	circular := map[string]Diagnostics{"j": gr.Variables[1].Expr.Diags, "m": gr.Variables[2].Expr.Diags, "w": gr.Helpers[1].Diags}
+	for _, ln := range gr.Lines[2:] {
+		circular[ln.Name] = ln.Expr.Diags
+	}
+	for name, ds := range circular {
+		if len(ds) != 1 || !strings.Contains(ds[0].Msg, "circular definitions") {
+			t.Errorf("%v: expected a circular definition but got %v", name, ds)
+		}
+	}
+	// evaluating them does not recurse forever
+	env := &Env{State: NewEvalState(NewRand(DrawStream))}
+	for _, ln := range gr.Lines[2:] {
+		ln.Expr.EvalEnv(ln.Env(env, 1))
+	}
+}
+
+func TestStartPos(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	gr.Params.Defaults()
+	gr.Lines = Lines{newTestLine("f", "x")}
+	gr.Helpers, gr.Variables = nil, nil
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.AddLineFunctions()
+
+	// the errors of the start position are reported even without marbles
+	gr.Params.NMarbles = 0
+	gr.Params.MarbleStartX.Expr = "(1, 2)"
+	gr.CompileExprs()
+	if ds := gr.Diagnostics(); len(ds) != 1 || ds[0].Field != "MarbleStartX" {
+		t.Errorf("expected an error in MarbleStartX but got %v", ds)
+	}
+
+	// the marbles only evaluate it, so they do not compile anything
+	gr.Params.NMarbles = 20
+	gr.Params.MarbleStartX.Expr = "n/10"
+	gr.CompileExprs()
+	gen := memoGen
+	gr.InitMarbles()
+	if memoGen != gen {
+		t.Error("expected the marbles to not compile anything")
+	}
+	if p := gr.Marbles[15].Pos; p.X != 1.5 {
+		t.Errorf("expected marble 15 to start at x = 1.5 but got %v", p)
+	}
+}
+
+// TestUpdateVariable checks that changing a slider only recompiles what uses it, without resetting the marbles
+func TestUpdateVariable(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	gr.Objects.Graph = &core.Canvas{}
+	defer func() { gr.Objects.Graph, gr.Variables = nil, nil }()
+	gr.Params.Defaults()
+	gr.Params.NMarbles = 10
+	f, g := newTestLine("f", "sx - 5"), newTestLine("g", "x^2/10 - 8")
+	g.GraphIf.Expr = "x > 0"
+	gr.Lines = Lines{f, g}
+	gr.Helpers = nil
+	gr.Variables = Variables{{Name: "s", Expr: Expr{Expr: "2"}, Min: 0, Max: 10}}
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.AddLineFunctions()
+	gr.CompileExprs()
+	if ds := gr.Diagnostics(); len(ds) > 0 {
+		t.Fatal(ds)
+	}
+	gr.Vectors.Min = math32.Vector2{X: -GraphViewBoxSize, Y: -GraphViewBoxSize}
+	gr.Vectors.Max = math32.Vector2{X: GraphViewBoxSize, Y: GraphViewBoxSize}
+	gr.Vectors.Size = gr.Vectors.Max.Sub(gr.Vectors.Min)
+	gr.InitMarbles()
+	for range 20 {
+		gr.UpdateMarblesData()
+		gr.AdvanceTime()
+	}
+	if gr.PlayVariables(); gr.State.Playing.Load() {
+		t.Error("expected nothing to be animated without a playing slider")
+	}
+	fVal, gVal, gIf := f.Expr.Val, g.Expr.Val, g.GraphIf.Val
+	marbles := slices.Clone(gr.Marbles)
+	pos := make([]math32.Vector2, len(marbles))
+	for i, m := range marbles {
+		pos[i] = m.Pos
+	}
+
+	v := gr.Variables[0]
+	v.SetValue(3)
+	gr.UpdateVariable(v)
+	if f.Expr.Val == fVal || f.Expr.EvalEnv(&Env{X: 2}) != 1 {
+		t.Errorf("expected f to be recompiled with s = 3")
+	}
+	if g.Expr.Val != gVal || g.GraphIf.Val != gIf {
+		t.Errorf("expected g to keep its compiled expressions")
+	}
+	if !slices.Equal(gr.Marbles, marbles) {
+		t.Fatal("expected the same marbles")
+	}
+	for i, m := range gr.Marbles {
+		if m.Pos != pos[i] {
+			t.Errorf("expected marble %v to stay at %v but it is at %v", i, pos[i], m.Pos)
+		}
+	}
+}
+
+func TestMarbleVarsInLines(t *testing.T) {
+	TheSettings.Defaults()
+	gr := &TheGraph
+	f, g := newTestLine("f", "x + k"), newTestLine("g", "x")
+	f.GraphIf.Expr = "speed > 1"
+	g.Bounce.Expr = "0.1n + k"
+	gr.Lines = Lines{f, g}
+	gr.Helpers = nil
+	gr.Variables = Variables{{Name: "k", Expr: Expr{Expr: "vx"}}}
+	defer func() { gr.Variables = nil }()
+	gr.SetFunctionsTo(DefaultFunctions)
+	gr.AddLineFunctions()
+	gr.CompileExprs()
+	ds := gr.Diagnostics()
+	if len(ds) != 1 || ds[0].Name != "f" || ds[0].Field != "Expr" || !strings.HasPrefix(ds[0].Msg, "vx is always 0") {
+		t.Errorf("expected vx to be reported in the expression of f but got %v", ds)
+	}
+	if f.Expr.Val == nil {
+		t.Error("expected f to still be graphed")
+	}
+	SetCompleteWords(gr.Functions, gr.Variables)
+	if slices.Contains(CompleteWords, "n") || !slices.Contains(CompleteWords, "speed") {
+		t.Errorf("expected the marble variables other than n to be completed but got %v", CompleteWords)
+	}
+}
+
+func TestRandintLargeRange(t *testing.T) {
+	fn := DefaultFunctions["randint"]
+	env := &Env{State: NewEvalState(NewRand(DrawStream))}
+	for _, r := range [][2]float64{{0, 1e19}, {-1e300, 1e300}, {-3, 3}} {
+		for range 100 {
+			v := fn.Call(env, r[:])
+			if !(v >= r[0] && v <= r[1]) || v != math.Floor(v) {
+				t.Fatalf("randint(%v, %v) = %v is not a whole number in the range", r[0], r[1], v)
+			}
+		}
+	}
+}
+
+func TestArgRange(t *testing.T) {
+	TheGraph.SetFunctionsTo(DefaultFunctions)
+	TheGraph.Variables = nil
+	for s, ok := range map[string]bool{"perlin(x)": true, "perlin(x, t)": true, "perlin(x, t, 1)": false, "max(1, 2, 3)": true, "sin(x, 1)": false} {
+		ex := Expr{Expr: s}
+		if err := ex.Compile(); (err == nil) != ok {
+			t.Errorf("%s: expected it to compile to be %v but got error %v", s, ok, err)
+		}
+	}
+	SetCompleteWords(TheGraph.Functions, nil)
+	if slices.Contains(CompleteWords, "perlin'") || slices.Contains(CompleteWords, "fbm'") {
+		t.Error("expected the internal derivatives of the noise functions to not be completed")
+	}
+}
+
+func TestGaussKronrod(t *testing.T) {
+	// 15 point Gauss–Kronrod quadrature is exact for polynomials up to degree 22, and 7 point Gauss up to 13
+	for _, deg := range []float64{0, 1, 5, 13, 22} {
+		val, err := gaussKronrod(func(x float64) float64 { return math.Pow(x, deg) }, 0, 1)
+		if want := 1 / (deg + 1); math.Abs(val-want) > 1e-15 {
+			t.Errorf("x^%v: expected %v but got %v", deg, want, val)
+		}
+		if deg <= 13 && err > 1e-15 {
+			t.Errorf("x^%v: expected no error but got %v", deg, err)
+		}
+	}
+}
+
+func TestIntegrateFunc(t *testing.T) {
+	cases := []struct {
+		f        func(x float64) float64
+		min, max float64
+		want     float64
+	}{
+		{math.Sin, 0, math.Pi, 2},
+		{func(x float64) float64 { return x }, 1, 0, -0.5},
+		{math.Sqrt, 0, 1, 2.0 / 3},
+		{func(x float64) float64 { return math.Exp(-x) }, 0, math.Inf(1), 1},
+		{func(x float64) float64 { return 1 / (x * x) }, 1, math.Inf(1), 1},
+		{func(x float64) float64 { return 1 / (1 + x*x) }, math.Inf(-1), 0, math.Pi / 2},
+		{func(x float64) float64 { return math.Exp(-x * x) }, math.Inf(-1), math.Inf(1), math.SqrtPi},
+	}
+	for _, c := range cases {
+		if have := IntegrateFunc(c.f, c.min, c.max); math.Abs(have-c.want) > 1e-7 {
+			t.Errorf("from %v to %v: expected %v but got %v", c.min, c.max, c.want, have)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"html"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Format is a way of formatting a syntax tree as text
+type Format int
+
+const (
+	// FormatText is canonical text in the Marbles math dialect, which can be parsed again
+	FormatText Format = iota
+
+	// FormatLaTeX is LaTeX math, for worksheets
+	FormatLaTeX
+
+	// FormatHTML is the rich text that previews the typeset expression in the app
+	FormatHTML
+)
+
+// TextNames are the symbols that names are written as in [FormatText] and [FormatHTML], like √ for sqrt
+var TextNames = map[string]string{
+	"sqrt": "√",
+	"inf":  "∞",
+	"int":  "∫",
+	"prod": "∏",
+	"sum":  "Σ",
+}
+
+// LaTeXNames are the names that are LaTeX commands
+var LaTeXNames = map[string]string{
+	"π": `\pi`, "θ": `\theta`, "α": `\alpha`, "β": `\beta`, "γ": `\gamma`, "δ": `\delta`, "λ": `\lambda`,
+	"μ": `\mu`, "σ": `\sigma`, "τ": `\tau`, "φ": `\phi`, "ω": `\omega`, "inf": `\infty`,
+	"sin": `\sin`, "cos": `\cos`, "tan": `\tan`, "sec": `\sec`, "csc": `\csc`, "cot": `\cot`,
+	"sinh": `\sinh`, "cosh": `\cosh`, "tanh": `\tanh`, "coth": `\coth`,
+	"arcsin": `\arcsin`, "arccos": `\arccos`, "arctan": `\arctan`,
+	"ln": `\ln`, "exp": `\exp`, "min": `\min`, "max": `\max`, "gcd": `\gcd`,
+}
+
+// FormatNode returns the given syntax tree formatted in the given format with only the parentheses
+// that are needed. It does not simplify the expression; use [Simplify] for that first.
+func FormatNode(n Node, f Format) string {
+	return formatter{f}.node(n)
+}
+
+// formatter formats syntax trees in a [Format]
+type formatter struct {
+	f Format
+}
+
+// prec returns the precedence of the node in the grammar of [ParseExpr], from 1 for || to 9 for primaries
+func (fm formatter) prec(n Node) int {
+	switch n := n.(type) {
+	case *ParenNode:
+		return fm.prec(n.X)
+	case *BinaryNode:
+		switch n.Op {
+		case "||":
+			return 1
+		case "&&":
+			return 2
+		case "+", "-":
+			return 4
+		case "*", "%":
+			return 5
+		case "/":
+			if fm.f == FormatLaTeX { // a fraction is only grouped in a power
+				return 6
+			}
+			return 5
+		case "^":
+			return 7
+		}
+		return 3
+	case *UnaryNode:
+		return 6
+	case *NumberNode:
+		if n.Val < 0 {
+			return 6
+		}
+	case *MemberNode:
+		return 8
+	}
+	return 9
+}
+
+// wrap formats the node, in parentheses if its precedence is lower than min
+func (fm formatter) wrap(n Node, min int) string {
+	s := fm.node(n)
+	if fm.prec(n) >= min {
+		return s
+	}
+	if fm.f == FormatLaTeX {
+		return `\left(` + s + `\right)`
+	}
+	return "(" + s + ")"
+}
+
+// name formats the name of a variable or function
+func (fm formatter) name(name string) string {
+	switch fm.f {
+	case FormatLaTeX:
+		if l, ok := LaTeXNames[name]; ok {
+			return l
+		}
+		name = strings.ReplaceAll(name, `"`, "''")
+		if n := len(strings.TrimRight(name, "'")); n > 1 {
+			return `\operatorname{` + name[:n] + "}" + name[n:]
+		}
+		return name
+	case FormatHTML:
+		if t, ok := TextNames[name]; ok {
+			return t
+		}
+		if len([]rune(strings.TrimRight(name, `'"`))) == 1 && name != "π" {
+			return "<i>" + html.EscapeString(name) + "</i>"
+		}
+		return html.EscapeString(name)
+	}
+	if t, ok := TextNames[name]; ok {
+		return t
+	}
+	return name
+}
+
+// op formats a binary or unary operator
+func (fm formatter) op(op string) string {
+	switch fm.f {
+	case FormatLaTeX:
+		if l, ok := map[string]string{"==": "=", "!=": `\neq`, "<=": `\leq`, ">=": `\geq`, "&&": `\land`, "||": `\lor`, "!": `\lnot `, "%": `\bmod`}[op]; ok {
+			return l
+		}
+	case FormatHTML:
+		if h, ok := map[string]string{"-": "−", "==": "=", "!=": "≠", "<=": "≤", ">=": "≥", "&&": "∧", "||": "∨", "!": "¬", "%": "mod"}[op]; ok {
+			return h
+		}
+		return html.EscapeString(op)
+	}
+	return op
+}
+
+// unparen returns the node inside of any parentheses
+func unparen(n Node) Node {
+	for {
+		p, ok := n.(*ParenNode)
+		if !ok {
+			return n
+		}
+		n = p.X
+	}
+}
+
+// leftmost returns the node that the formatted node starts with
+func leftmost(n Node) Node {
+	for {
+		switch m := n.(type) {
+		case *ParenNode:
+			n = m.X
+		case *BinaryNode:
+			n = m.X
+		case *MemberNode:
+			n = m.X
+		default:
+			return n
+		}
+	}
+}
+
+// node formats the node
+func (fm formatter) node(n Node) string {
+	switch n := n.(type) {
+	case *NumberNode:
+		return n.String()
+	case *BoolNode:
+		if fm.f == FormatLaTeX {
+			return `\text{` + n.String() + "}"
+		}
+		return n.String()
+	case *VarNode:
+		return fm.name(n.Name)
+	case *FuncNode:
+		return fm.name(n.Name)
+	case *ParenNode:
+		return fm.node(n.X)
+	case *UnaryNode:
+		return fm.op(n.Op) + fm.wrap(n.X, 7)
+	case *BinaryNode:
+		return fm.binary(n)
+	case *CallNode:
+		return fm.call(n)
+	case *PointNode:
+		return fm.parens(fm.node(n.X) + ", " + fm.node(n.Y))
+	case *MemberNode:
+		if fm.f == FormatLaTeX {
+			return fm.wrap(n.X, 9) + "_{" + n.Field + "}"
+		}
+		return fm.wrap(n.X, 8) + "." + n.Field
+	case *NumDerivNode:
+		return fm.call(&CallNode{Name: "d", Args: []Node{n.X, &VarNode{Name: n.Var}}, Paren: true})
+	case *PiecewiseNode:
+		return fm.piecewise(n)
+	}
+	return n.String()
+}
+
+// parens returns s in parentheses
+func (fm formatter) parens(s string) string {
+	if fm.f == FormatLaTeX {
+		return `\left(` + s + `\right)`
+	}
+	return "(" + s + ")"
+}
+
+// binary formats a binary operation
+func (fm formatter) binary(n *BinaryNode) string {
+	p := fm.prec(n)
+	switch n.Op {
+	case "^":
+		if fm.f == FormatLaTeX {
+			return fm.wrap(n.X, 8) + "^{" + fm.node(n.Y) + "}"
+		}
+		if fm.f == FormatHTML {
+			return fm.wrap(n.X, 8) + "<sup>" + fm.node(n.Y) + "</sup>"
+		}
+		return fm.wrap(n.X, 8) + "^" + fm.wrap(n.Y, 6)
+	case "/":
+		if fm.f == FormatLaTeX {
+			return `\frac{` + fm.node(n.X) + "}{" + fm.node(n.Y) + "}"
+		}
+		return fm.wrap(n.X, 5) + "/" + fm.wrap(n.Y, 6)
+	case "*":
+		ymin := 6
+		if _, ok := unparen(n.Y).(*BinaryNode); !ok && fm.prec(n.Y) == 6 { // like 2(-x) or 2(-3)
+			ymin = 7
+		}
+		x, y := fm.wrap(n.X, 5), fm.wrap(n.Y, ymin)
+		_, xNum := leftmost(n.X).(*NumberNode)
+		_, yNum := leftmost(n.Y).(*NumberNode)
+		if fm.prec(n.Y) < ymin {
+			yNum = false // it starts with a parenthesis
+		}
+		switch {
+		case yNum:
+			// the numbers would run together without an operator
+			return x + map[Format]string{FormatText: "*", FormatLaTeX: ` \cdot `, FormatHTML: "·"}[fm.f] + y
+		case fm.f == FormatLaTeX:
+			return x + " " + y
+		case xNum && fm.prec(n.X) == 9:
+			return x + y // like 2x
+		case fm.f == FormatHTML:
+			return x + " " + y
+		}
+		return x + "*" + y
+	case "%":
+		return fm.wrap(n.X, 5) + " " + fm.op(n.Op) + " " + fm.wrap(n.Y, 6)
+	}
+	lmin, rmin := p, p+1
+	if p == 3 { // comparisons do not chain
+		lmin = 4
+	}
+	return fm.wrap(n.X, lmin) + " " + fm.op(n.Op) + " " + fm.wrap(n.Y, rmin)
+}
+
+// call formats a function call
+func (fm formatter) call(n *CallNode) string {
+	if len(n.Args) == 0 {
+		if !n.Paren || fm.f != FormatText {
+			return fm.name(n.Name)
+		}
+		return fm.name(n.Name) + "()"
+	}
+	args := make([]string, len(n.Args))
+	for i, a := range n.Args {
+		args[i] = fm.node(a)
+	}
+	if fm.f == FormatLaTeX {
+		switch {
+		case n.Name == "sqrt" && len(args) == 1:
+			return `\sqrt{` + args[0] + "}"
+		case n.Name == "cbrt" && len(args) == 1:
+			return `\sqrt[3]{` + args[0] + "}"
+		case n.Name == "abs" && len(args) == 1:
+			return `\left|` + args[0] + `\right|`
+		case n.Name == "floor" && len(args) == 1:
+			return `\left\lfloor ` + args[0] + ` \right\rfloor`
+		case n.Name == "ceil" && len(args) == 1:
+			return `\left\lceil ` + args[0] + ` \right\rceil`
+		case n.Name == "exp" && len(args) == 1:
+			return "e^{" + args[0] + "}"
+		case n.Name == "log" && len(args) == 2:
+			return `\log_{` + args[1] + "}" + fm.parens(args[0])
+		case (n.Name == "sum" || n.Name == "prod") && len(args) == 4:
+			return `\` + n.Name + "_{" + args[0] + "=" + args[1] + "}^{" + args[2] + "} " + fm.wrap(n.Args[3], 5)
+		case n.Name == "int" && len(args) == 4:
+			return `\int_{` + args[2] + "}^{" + args[3] + "} " + fm.wrap(n.Args[0], 5) + `\,d` + args[1]
+		case n.Name == "d" && len(args) == 2:
+			return `\frac{d}{d` + args[1] + "}" + fm.parens(args[0])
+		}
+	}
+	if fm.f == FormatHTML && n.Name == "abs" && len(args) == 1 {
+		return "|" + args[0] + "|"
+	}
+	return fm.name(n.Name) + fm.parens(strings.Join(args, ", "))
+}
+
+// piecewise formats a piecewise expression
+func (fm formatter) piecewise(n *PiecewiseNode) string {
+	cases := []string{}
+	for i, c := range n.Conds {
+		if fm.f == FormatLaTeX {
+			cases = append(cases, fm.node(n.Vals[i])+` & \text{if } `+fm.node(c))
+		} else {
+			cases = append(cases, fm.node(c)+": "+fm.node(n.Vals[i]))
+		}
+	}
+	if n.Else != nil {
+		if fm.f == FormatLaTeX {
+			cases = append(cases, fm.node(n.Else)+` & \text{otherwise}`)
+		} else {
+			cases = append(cases, fm.node(n.Else))
+		}
+	}
+	if fm.f == FormatLaTeX {
+		return `\begin{cases} ` + strings.Join(cases, ` \\ `) + ` \end{cases}`
+	}
+	return "{" + strings.Join(cases, ", ") + "}"
+}
+
+// Simplify returns the syntax tree without redundant parentheses, with the operations on numbers
+// that give short numbers folded, like 7^2 to 49, and with adding 0 and multiplying by 1 removed.
+// Numbers that would be long, like sqrt(2), are left as they are so that the expression stays readable.
+func Simplify(n Node) Node {
+	switch n := n.(type) {
+	case *ParenNode:
+		return Simplify(n.X)
+	case *UnaryNode:
+		x := Simplify(n.X)
+		switch {
+		case n.Op == "+":
+			return x
+		case n.Op == "-" && isNumber(x):
+			return num(-x.(*NumberNode).Val)
+		case n.Op == "-":
+			if u, ok := x.(*UnaryNode); ok && u.Op == "-" {
+				return u.X
+			}
+		}
+		return &UnaryNode{Op: n.Op, X: x, OpPos: n.OpPos}
+	case *BinaryNode:
+		x, y := Simplify(n.X), Simplify(n.Y)
+		if isNumber(x) && isNumber(y) {
+			if v, ok := foldBinary(n.Op, x.(*NumberNode).Val, y.(*NumberNode).Val); ok && isShort(v) {
+				return num(v)
+			}
+		}
+		switch {
+		case n.Op == "+" && isNum(x, 0):
+			return y
+		case (n.Op == "+" || n.Op == "-") && isNum(y, 0):
+			return x
+		case n.Op == "*" && isNum(x, 1):
+			return y
+		case (n.Op == "*" || n.Op == "/" || n.Op == "^") && isNum(y, 1):
+			return x
+		}
+		return &BinaryNode{Op: n.Op, X: x, Y: y}
+	case *CallNode:
+		args := make([]Node, len(n.Args))
+		allNums := len(args) > 0
+		for i, a := range n.Args {
+			args[i] = Simplify(a)
+			allNums = allNums && isNumber(args[i])
+		}
+		fn := DefaultFunctions[n.Name]
+		if allNums && fn != nil && fn.Pure && fn.Funcs == 0 && (fn.Call != nil || fn.Call1 != nil) && (fn.NArgs == -1 || fn.NArgs == len(args)) {
+			vals := make([]float64, len(args))
+			for i, a := range args {
+				vals[i] = a.(*NumberNode).Val
+			}
+			var v float64
+			if fn.Call != nil {
+				v = fn.Call(&Env{}, vals)
+			} else {
+				v = fn.Call1(&Env{}, vals[0])
+			}
+			if isShort(v) {
+				return num(v)
+			}
+		}
+		return &CallNode{Name: n.Name, Args: args, Paren: n.Paren || len(args) > 0, NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+	case *PointNode:
+		return &PointNode{X: Simplify(n.X), Y: Simplify(n.Y), NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+	case *MemberNode:
+		x := Simplify(n.X)
+		if p, ok := x.(*PointNode); ok {
+			if n.Field == "x" {
+				return p.X
+			}
+			return p.Y
+		}
+		return &MemberNode{X: x, Field: n.Field, NodeEnd: n.NodeEnd}
+	case *PiecewiseNode:
+		res := &PiecewiseNode{NodePos: n.NodePos, NodeEnd: n.NodeEnd}
+		for i, c := range n.Conds {
+			res.Conds = append(res.Conds, Simplify(c))
+			res.Vals = append(res.Vals, Simplify(n.Vals[i]))
+		}
+		if n.Else != nil {
+			res.Else = Simplify(n.Else)
+		}
+		return res
+	case *NumDerivNode:
+		return &NumDerivNode{X: Simplify(n.X), Var: n.Var}
+	}
+	return n
+}
+
+// isNumber returns whether the node is a number
+func isNumber(n Node) bool {
+	_, ok := n.(*NumberNode)
+	return ok
+}
+
+// foldBinary returns the result of the arithmetic operation on two numbers, and whether it is arithmetic
+func foldBinary(op string, a, b float64) (float64, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		return a / b, true
+	case "^":
+		return math.Pow(a, b), true
+	case "%":
+		return math.Mod(a, b), true
+	}
+	return 0, false
+}
+
+// isShort returns whether the number is finite and has at most 6 significant digits,
+// so that it is as readable as the expression it replaces
+func isShort(v float64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return false
+	}
+	s := strconv.FormatFloat(math.Abs(v), 'g', -1, 64)
+	return !strings.ContainsAny(s, "e") && len(strings.Trim(strings.ReplaceAll(s, ".", ""), "0")) <= 6
+}
+
+// Text returns the expression as canonical text, simplified with [Simplify]
+func (ex *Expr) Text() string {
+	if ex.Node == nil {
+		return ex.Expr
+	}
+	return FormatNode(Simplify(ex.Node), FormatText)
+}
+
+// LaTeX returns the expression as LaTeX, simplified with [Simplify]
+func (ex *Expr) LaTeX() string {
+	if ex.Node == nil {
+		return ""
+	}
+	return FormatNode(Simplify(ex.Node), FormatLaTeX)
+}
+
+// LaTeX returns the equation of the line as LaTeX, like f(x) = x^{2}
+func (ln *Line) LaTeX() string {
+	lhs := "y"
+	if ln.Name != "" {
+		lhs = FormatNode(&CallNode{Name: ln.Name, Args: []Node{&VarNode{Name: "x"}}}, FormatLaTeX)
+	}
+	return lhs + " = " + ln.Expr.LaTeX()
+}
+
+// Preview returns the equation of the line as rich text that shows it typeset
+func (ln *Line) Preview() string {
+	lhs := "<i>y</i>"
+	if ln.Name != "" {
+		lhs = FormatNode(&CallNode{Name: ln.Name, Args: []Node{&VarNode{Name: "x"}}}, FormatHTML)
+	}
+	if ln.Expr.Node == nil {
+		return lhs + " = " + html.EscapeString(ln.Expr.Expr)
+	}
+	return lhs + " = " + FormatNode(Simplify(ln.Expr.Node), FormatHTML)
+}
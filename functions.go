@@ -3,99 +3,167 @@ package main
 import (
 	"fmt"
 	"math"
-	"math/rand"
+	"math/rand/v2"
+	"slices"
 	"strings"
+	"unicode"
 
-	"github.com/Knetic/govaluate"
 	"gonum.org/v1/gonum/diff/fd"
 )
 
 // Functions are a map of named expression functions
-type Functions map[string]govaluate.ExpressionFunction
+type Functions map[string]*Function
+
+// Function is a function that can be used in expressions
+type Function struct {
+
+	// NArgs is the number of arguments the function takes, or -1 if it takes any number of arguments
+	NArgs int
+
+	// Pure is whether the function always returns the same value for the same arguments,
+	// which allows calls with constant arguments to be evaluated when compiling
+	Pure bool
+
+	// Call calls the function with the given arguments in the given environment
+	Call func(env *Env, args []float64) float64
+
+	// Call1 is an optional version of Call for functions that take one argument, which avoids allocating the arguments
+	Call1 func(env *Env, x float64) float64
+
+	// Deriv is the name of the function that is the derivative of this one with respect to its first argument,
+	// which takes the same arguments. It is used by [Derivative] for functions that are not in [DerivRules]
+	// when the other arguments do not depend on the variable.
+	Deriv string
+
+	// Expand is an optional function that returns the body of a function defined by an expression,
+	// with the given arguments in place of its parameters. It is used by [Derivative].
+	Expand func(args []Node) Node
+
+	// Funcs is the number of leading arguments that are the names of functions of one argument
+	// instead of values, like f in root(f, a, b). Functions with them are called with CallFuncs.
+	Funcs int
+
+	// Params are the names of the parameters of the function, which are shown in its [Function.Signature].
+	// The last one ends with ... if the function takes any number of arguments.
+	Params []string
+
+	// Doc is a short description of the function, which is shown when completing it
+	Doc string
+
+	// Internal is whether the function is only there for the results of [Derivative], like perlin',
+	// so that it is not offered when completing
+	Internal bool
+
+	// CallFuncs calls a function with [Function.Funcs], with the referenced functions and the values
+	// of the other arguments. It returns an error along with NaN if there is no result.
+	CallFuncs func(env *Env, fs []FuncArg, args []float64) (float64, error)
+
+	// Lines is the number of leading arguments that are the names of lines instead of values,
+	// like f in hits(f). Functions with them are called with CallLines.
+	Lines int
+
+	// CallLines calls a function with [Function.Lines], with the referenced lines and the values of the other arguments
+	CallLines func(env *Env, lines []LineArg, args []float64) float64
+}
+
+// FuncArg is a function passed by name as an argument, like f in root(f, a, b)
+type FuncArg func(env *Env, x float64) float64
 
 // NewFuncV makes a function that can be used in expressions from a function that takes a variadic input and returns a single value.
-func NewFuncV[I, O any](f func(...I) O) govaluate.ExpressionFunction {
-	return func(args ...any) (any, error) {
-		newArgs := []I{}
-		for i, arg := range args {
-			a, ok := arg.(I)
-			if !ok {
-				return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument %v", f, arg, i)
-			}
-			newArgs = append(newArgs, a)
-		}
-		res := f(newArgs...)
-		return res, nil
-	}
+func NewFuncV(f func(...float64) float64) *Function {
+	return &Function{NArgs: -1, Pure: true, Call: func(env *Env, args []float64) float64 {
+		return f(args...)
+	}}
 }
 
 // NewFunc0 makes a function that can be used in expressions from a function that takes no arguments and returns a single value.
-// IMPORTANT: zero arg functions must be added to [ZeroArgFunctions].
-func NewFunc0[O any](f func() O) govaluate.ExpressionFunction {
-	return func(args ...any) (any, error) {
-		if len(args) != 0 {
-			return nil, fmt.Errorf("evaluation error: function of type %T wants 0 arguments, not %v arguments", f, len(args))
-		}
-		res := f()
-		return res, nil
-	}
+// Functions without arguments can be used without parentheses, like rand.
+func NewFunc0(f func() float64) *Function {
+	return &Function{NArgs: 0, Call: func(env *Env, args []float64) float64 {
+		return f()
+	}}
 }
 
 // NewFunc1 makes a function that can be used in expressions from a function that takes a single argument and returns a single value.
-func NewFunc1[I, O any](f func(I) O) govaluate.ExpressionFunction {
-	return func(args ...any) (any, error) {
-		if len(args) != 1 {
-			return nil, fmt.Errorf("evaluation error: function of type %T wants 1 argument, not %v arguments", f, len(args))
-		}
-		arg0, ok := args[0].(I)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T", f, args[0])
-		}
-		res := f(arg0)
-		return res, nil
-	}
+func NewFunc1(f func(float64) float64) *Function {
+	return &Function{NArgs: 1, Pure: true, Call: func(env *Env, args []float64) float64 {
+		return f(args[0])
+	}, Call1: func(env *Env, x float64) float64 {
+		return f(x)
+	}}
 }
 
 // NewFunc2 makes a function that can be used in expressions from a function that takes two arguments and returns a single value.
-func NewFunc2[I1, I2, O any](f func(I1, I2) O) govaluate.ExpressionFunction {
-	return func(args ...any) (any, error) {
-		if len(args) != 2 {
-			return nil, fmt.Errorf("evaluation error: function of type %T wants 2 arguments, not %v arguments", f, len(args))
-		}
-		arg0, ok := args[0].(I1)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument 0", f, args[0])
-		}
-		arg1, ok := args[1].(I2)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument 1", f, args[1])
-		}
-		res := f(arg0, arg1)
-		return res, nil
-	}
+func NewFunc2(f func(float64, float64) float64) *Function {
+	return &Function{NArgs: 2, Pure: true, Call: func(env *Env, args []float64) float64 {
+		return f(args[0], args[1])
+	}}
 }
 
 // NewFunc3 makes a function that can be used in expressions from a function that takes three arguments and returns a single value.
-func NewFunc3[I1, I2, I3, O any](f func(I1, I2, I3) O) govaluate.ExpressionFunction {
-	return func(args ...any) (any, error) {
-		if len(args) != 3 {
-			return nil, fmt.Errorf("evaluation error: function of type %T wants 3 arguments, not %v arguments", f, len(args))
-		}
-		arg0, ok := args[0].(I1)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument 0", f, args[0])
-		}
-		arg1, ok := args[1].(I2)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument 1", f, args[1])
+func NewFunc3(f func(float64, float64, float64) float64) *Function {
+	return &Function{NArgs: 3, Pure: true, Call: func(env *Env, args []float64) float64 {
+		return f(args[0], args[1], args[2])
+	}}
+}
+
+// WithDeriv sets the name of the function that is the derivative of the function and returns it
+func (fn *Function) WithDeriv(name string) *Function {
+	fn.Deriv = name
+	return fn
+}
+
+// AsInternal marks the function as [Function.Internal] and returns it
+func (fn *Function) AsInternal() *Function {
+	fn.Internal = true
+	return fn
+}
+
+// WithDoc sets the documentation of the function and the names of its parameters and returns it
+func (fn *Function) WithDoc(doc string, params ...string) *Function {
+	fn.Doc = doc
+	fn.Params = params
+	return fn
+}
+
+// Signature returns the signature of the function with the given name, like clamp(x, lo, hi).
+// Functions without [Function.Params] get parameter names based on how many arguments they take.
+func (fn *Function) Signature(name string) string {
+	params := fn.Params
+	if params == nil {
+		switch fn.NArgs {
+		case -1:
+			params = []string{"..."}
+		case 1:
+			params = []string{"x"}
+		default:
+			for i := range fn.NArgs {
+				params = append(params, string(rune('a'+i)))
+			}
 		}
-		arg2, ok := args[2].(I3)
-		if !ok {
-			return nil, fmt.Errorf("evaluation error: function of type %T does not accept input type %T for argument 2", f, args[2])
+	}
+	if fn.NArgs == 0 {
+		return name
+	}
+	return name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// ArgRange returns the fewest and most arguments that the function takes, where the most is -1 if there
+// is no limit. Functions that take any number of arguments can limit it with [Function.Params],
+// where optional parameters are in brackets, like t in perlin(x, [t]).
+func (fn *Function) ArgRange() (lo, hi int) {
+	if fn.NArgs >= 0 {
+		return fn.NArgs, fn.NArgs
+	}
+	if len(fn.Params) == 0 || strings.HasSuffix(fn.Params[len(fn.Params)-1], "...") {
+		return 0, -1
+	}
+	for _, p := range fn.Params {
+		if !strings.HasPrefix(p, "[") {
+			lo++
 		}
-		res := f(arg0, arg1, arg2)
-		return res, nil
 	}
+	return lo, len(fn.Params)
 }
 
 // DefaultFunctions are the default functions that can be used in expressions
@@ -157,9 +225,15 @@ var DefaultFunctions = Functions{
 		return math.Log(x) / math.Log(base)
 	}),
 	"abs": NewFunc1(math.Abs),
-	"pow": NewFunc2(math.Pow),
-	"exp": NewFunc1(math.Exp),
-	"mod": NewFunc2(math.Mod),
+	"re":  NewFunc1(func(x float64) float64 { return x }),
+	"im":  NewFunc1(func(x float64) float64 { return 0 }),
+	"arg": NewFunc1(func(x float64) float64 {
+		return math.Atan2(0, x)
+	}),
+	"conj": NewFunc1(func(x float64) float64 { return x }),
+	"pow":  NewFunc2(math.Pow),
+	"exp":  NewFunc1(math.Exp),
+	"mod":  NewFunc2(math.Mod),
 	"fact": NewFunc1(func(x float64) float64 {
 		return math.Gamma(x + 1)
 	}),
@@ -168,7 +242,7 @@ var DefaultFunctions = Functions{
 	"round": NewFunc1(math.Round),
 	"sqrt":  NewFunc1(math.Sqrt),
 	"cbrt":  NewFunc1(math.Cbrt),
-	"min": NewFuncV(func(v ...float64) any {
+	"min": NewFuncV(func(v ...float64) float64 {
 		if len(v) == 0 {
 			return 0
 		}
@@ -181,7 +255,7 @@ var DefaultFunctions = Functions{
 		}
 		return min
 	}),
-	"max": NewFuncV(func(v ...float64) any {
+	"max": NewFuncV(func(v ...float64) float64 {
 		if len(v) == 0 {
 			return 0
 		}
@@ -194,7 +268,7 @@ var DefaultFunctions = Functions{
 		}
 		return max
 	}),
-	"avg": NewFuncV(func(v ...float64) any {
+	"avg": NewFuncV(func(v ...float64) float64 {
 		if len(v) == 0 {
 			return 0
 		}
@@ -204,33 +278,107 @@ var DefaultFunctions = Functions{
 		}
 		return total / float64(len(v))
 	}),
-	"if": NewFunc3(func(condition bool, val1, val2 any) any {
-		if condition {
-			return val1
+	"root":      {NArgs: 3, Funcs: 1, Pure: true, CallFuncs: Root, Params: []string{"f", "a", "b"}, Doc: "the first x between a and b where f(x) = 0"},
+	"intersect": {NArgs: 3, Funcs: 2, Pure: true, CallFuncs: Intersect, Params: []string{"f", "g", "x0"}, Doc: "the x closest to x0 where f(x) = g(x)"},
+	"argmin":    {NArgs: 3, Funcs: 1, Pure: true, CallFuncs: Argmin, Params: []string{"f", "a", "b"}, Doc: "the x between a and b where f(x) is smallest"},
+	"argmax":    {NArgs: 3, Funcs: 1, Pure: true, CallFuncs: Argmax, Params: []string{"f", "a", "b"}, Doc: "the x between a and b where f(x) is largest"},
+
+	"hits":        {NArgs: 1, Lines: 1, CallLines: Hits, Params: []string{"f"}, Doc: "the number of times the marbles have hit the line f"},
+	"hitsSince":   {NArgs: 2, Lines: 1, CallLines: HitsSince, Params: []string{"f", "s"}, Doc: "the number of times the marbles have hit the line f since time t - s"},
+	"lastHitTime": {NArgs: 1, Lines: 1, CallLines: LastHitTime, Params: []string{"f"}, Doc: "the time that the marbles last hit the line f, or NaN if they have not hit it"},
+	"marbleHits":  {NArgs: 1, Lines: 1, CallLines: MarbleHits, Params: []string{"f"}, Doc: "the number of times the marble has hit the line f"},
+	// the noise functions depend on the seed, and their derivatives with respect to x have a ' after their name
+	"perlin":  {NArgs: -1, Pure: true, Deriv: "perlin'", Call: Perlin, Params: []string{"x", "[t]"}, Doc: "smooth noise between -1 and 1, which changes over t if it is given"},
+	"perlin'": {NArgs: -1, Pure: true, Internal: true, Call: PerlinDeriv, Params: []string{"x", "[t]"}},
+	"simplex": NewFunc2(func(x, y float64) float64 {
+		v, _, _ := Simplex2(x, y)
+		return v
+	}).WithDeriv("simplex'").WithDoc("2D simplex noise between about -1 and 1", "x", "y"),
+	"simplex'": NewFunc2(func(x, y float64) float64 {
+		_, d, _ := Simplex2(x, y)
+		return d
+	}).AsInternal(),
+	"fbm": NewFunc3(func(x, octaves, persistence float64) float64 {
+		v, _ := FBM(x, octaves, persistence)
+		return v
+	}).WithDeriv("fbm'").WithDoc("Perlin noise with detail from each octave at twice the frequency and persistence times the amplitude", "x", "octaves", "persistence"),
+	"fbm'": NewFunc3(func(x, octaves, persistence float64) float64 {
+		_, d := FBM(x, octaves, persistence)
+		return d
+	}).AsInternal(),
+	"rand": NewRandFunc(0, func(r *rand.Rand, args []float64) float64 {
+		return r.Float64()
+	}).WithDoc("a random number between 0 and 1"),
+	"randn": NewRandFunc(2, func(r *rand.Rand, args []float64) float64 {
+		return args[0] + args[1]*r.NormFloat64()
+	}).WithDoc("a normally distributed random number with mean mu and standard deviation sigma", "mu", "sigma"),
+	"randint": NewRandFunc(2, func(r *rand.Rand, args []float64) float64 {
+		lo, hi := math.Ceil(min(args[0], args[1])), math.Floor(max(args[0], args[1]))
+		if !(hi >= lo) || math.IsInf(hi-lo, 0) {
+			return math.NaN()
 		}
-		return val2
-	}),
-	// IMPORTANT: zero arg functions must be added to [ZeroArgFunctions].
-	"rand": NewFunc0(rand.Float64),
+		if hi-lo >= 1<<62 { // the range is too large for Int64N, so it is drawn with float64 arithmetic
+			return min(hi, lo+math.Floor(r.Float64()*(hi-lo+1)))
+		}
+		return lo + float64(r.Int64N(int64(hi-lo)+1))
+	}).WithDoc("a random whole number from a to b, including both", "a", "b"),
+	"choose": NewRandFunc(-1, func(r *rand.Rand, args []float64) float64 {
+		if len(args) == 0 {
+			return math.NaN()
+		}
+		return args[r.IntN(len(args))]
+	}).WithDoc("one of the arguments, picked at random", "x..."),
+	"exprand": NewRandFunc(1, func(r *rand.Rand, args []float64) float64 {
+		return r.ExpFloat64() / args[0]
+	}).WithDoc("an exponentially distributed random number with rate lambda", "lambda"),
 	"nmarbles": NewFunc0(func() float64 {
 		return float64(TheGraph.Params.NMarbles)
-	}),
+	}).WithDoc("the number of marbles"),
+	"count": (&Function{NArgs: 4, Call: func(env *Env, args []float64) float64 {
+		return TheGraph.Crowd().Count(args[0], args[1], args[2], args[3])
+	}}).WithDoc("the number of marbles in the box with corners (x1, y1) and (x2, y2)", "x1", "y1", "x2", "y2"),
+	"meanx": NewFunc0(func() float64 {
+		return TheGraph.Crowd().MeanX
+	}).WithDoc("the mean x of the marbles in the graph"),
+	"meany": NewFunc0(func() float64 {
+		return TheGraph.Crowd().MeanY
+	}).WithDoc("the mean y of the marbles in the graph"),
+	"maxy": NewFunc0(func() float64 {
+		return TheGraph.Crowd().MaxY
+	}).WithDoc("the largest y of the marbles in the graph"),
+	"nalive": NewFunc0(func() float64 {
+		return float64(TheGraph.Crowd().Alive)
+	}).WithDoc("the number of marbles in the graph"),
 	"inf": NewFunc0(func() float64 {
 		return math.Inf(1)
-	}),
-}
-
-// CheckArgs checks if a function is passed the right number of arguments, and the right type of arguments.
-func CheckArgs(name string, have []any, want ...string) error {
-	if len(have) != len(want) {
-		return fmt.Errorf("function %v needs %v arguments, not %v arguments", name, len(want), len(have))
-	}
-	for i, d := range want {
-		if d != fmt.Sprintf("%T", have[i]) {
-			return fmt.Errorf("function %v needs %v. %v does not work", name, want, have)
-		}
-	}
-	return nil
+	}).WithDoc("infinity"),
+	"sign":       NewFunc1(Sign).WithDoc("-1, 0 or 1 depending on the sign of x", "x"),
+	"clamp":      NewFunc3(Clamp).WithDoc("x limited to be between lo and hi", "x", "lo", "hi"),
+	"lerp":       NewFunc3(Lerp).WithDoc("the linear interpolation from a at t = 0 to b at t = 1", "a", "b", "t"),
+	"smoothstep": NewFunc3(Smoothstep).WithDoc("0 below e0, 1 above e1 and a smooth curve between them", "e0", "e1", "x"),
+	"step":       NewFunc2(Step).WithDoc("0 for x below edge and 1 otherwise", "edge", "x"),
+	"frac":       NewFunc1(Frac).WithDoc("the fractional part of x, x - floor(x)", "x"),
+	"gcd":        NewFunc2(GCD).WithDoc("the greatest common divisor of whole numbers a and b", "a", "b"),
+	"lcm":        NewFunc2(LCM).WithDoc("the least common multiple of whole numbers a and b", "a", "b"),
+	"hypot":      NewFunc2(math.Hypot).WithDoc("the length of the hypotenuse, sqrt(x^2 + y^2)", "x", "y"),
+	"atan2":      NewFunc2(math.Atan2).WithDoc("the angle of the point (x, y) from the positive x axis, between -π and π", "y", "x"),
+	"erf":        NewFunc1(math.Erf).WithDoc("the error function of x", "x"),
+	"erfc":       NewFunc1(math.Erfc).WithDoc("the complementary error function of x, 1 - erf(x)", "x"),
+	"gamma":      NewFunc1(math.Gamma).WithDoc("the gamma function of x, which is (x-1)! for whole numbers", "x"),
+	"lgamma":     NewFunc1(Lgamma).WithDoc("the natural logarithm of the absolute value of gamma(x)", "x"),
+	"beta":       NewFunc2(Beta).WithDoc("the beta function of a and b, gamma(a)gamma(b)/gamma(a+b)", "a", "b"),
+	"J0":         NewFunc1(math.J0).WithDoc("the Bessel function of the first kind of order 0", "x"),
+	"J1":         NewFunc1(math.J1).WithDoc("the Bessel function of the first kind of order 1", "x"),
+	"sinc":       NewFunc1(Sinc).WithDoc("sin(x)/x, which is 1 at x = 0", "x"),
+	"tri":        NewFunc1(Tri).WithDoc("a triangle wave with the same period, phase and amplitude as sin", "x"),
+	"square":     NewFunc1(Square).WithDoc("a square wave that is 1 where sin(x) is positive and -1 elsewhere", "x"),
+	"saw":        NewFunc1(Saw).WithDoc("a sawtooth wave with period 2π that goes up from -1 to 1 and is 0 at x = 0", "x"),
+	"deg": NewFunc1(func(x float64) float64 {
+		return x * 180 / math.Pi
+	}).WithDoc("x radians in degrees", "x"),
+	"rad": NewFunc1(func(x float64) float64 {
+		return x * math.Pi / 180
+	}).WithDoc("x degrees in radians", "x"),
 }
 
 // SetFunctionsTo sets the functions of the graph to another set of functions
@@ -241,99 +389,188 @@ func (gr *Graph) SetFunctionsTo(functions Functions) {
 	}
 }
 
-// AddLineFunctions adds all of the line functions
+// AddLineFunctions checks the names of the lines and adds all of the line functions
 func (gr *Graph) AddLineFunctions() {
 	for k, ln := range gr.Lines {
-		ln.SetFunctionName(k)
+		ln.Diags = nil
+		if err := gr.CheckLineName(ln.Name, k); err != nil {
+			ln.Diags = Diagnostics{NewDiagnostic(Diagnostic{Line: k, Name: ln.Name, Field: "Name"}, err)}
+			continue
+		}
+		ln.AddFunctions()
 	}
 }
 
-// SetFunctionName sets the function name for a line and adds the function to the functions
-func (ln *Line) SetFunctionName(k int) {
-	if k >= len(FunctionNames) {
-		// ln.FuncName = "unassigned"
-		return
-	}
-	functionName := FunctionNames[k]
-	// ln.FuncName = functionName + "(x)="
-	TheGraph.Functions[functionName] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName, args, "float64")
-		if err != nil {
-			return 0, err
+// NameLines gives the lines without a name a default name from [FunctionNames],
+// using the name for their index if it is not used. It is used for files saved before
+// lines had names, which used those names for the lines, so that they keep their meaning.
+func (gr *Graph) NameLines() {
+	for k, ln := range gr.Lines {
+		if ln.Name != "" {
+			continue
 		}
-		val := float64(ln.Expr.Eval(args[0].(float64), TheGraph.State.Time, ln.TimesHit))
-		return val, nil
-	}
-	TheGraph.Functions[functionName+"'"] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+"'", args, "float64")
-		if err != nil {
-			return 0, err
+		if k < len(FunctionNames) && !gr.NameUsed(FunctionNames[k]) {
+			ln.Name = FunctionNames[k]
+		} else {
+			ln.Name = gr.UnusedLineName()
 		}
-		val := fd.Derivative(func(x float64) float64 {
-			return ln.Expr.Eval(x, TheGraph.State.Time, ln.TimesHit)
-		}, args[0].(float64), &fd.Settings{
-			Formula: fd.Central,
-		})
-		return val, nil
 	}
-	TheGraph.Functions[functionName+`"`] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+`"`, args, "float64")
-		if err != nil {
-			return 0, err
+}
+
+// NameUsed returns whether the given name is the name of a line, variable or helper
+func (gr *Graph) NameUsed(name string) bool {
+	return gr.Lines.HasName(name) || gr.Variables.Find(name) != nil || gr.Helpers.Find(name) != nil
+}
+
+// HasName returns whether any of the lines has the given name
+func (ls Lines) HasName(name string) bool {
+	for _, ln := range ls {
+		if ln.Name == name {
+			return true
 		}
-		val := fd.Derivative(func(x float64) float64 {
-			return ln.Expr.Eval(x, TheGraph.State.Time, ln.TimesHit)
-		}, args[0].(float64), &fd.Settings{
-			Formula: fd.Central2nd,
-		})
-		return val, nil
 	}
-	capitalName := strings.ToUpper(functionName)
-	TheGraph.Functions[capitalName] = func(args ...any) (any, error) {
-		err := CheckArgs(capitalName, args, "float64")
-		if err != nil {
-			return 0, err
+	return false
+}
+
+// UnusedLineName returns the first name in [FunctionNames] that is not the name
+// of a line, variable or helper, or "" if they are all used
+func (gr *Graph) UnusedLineName() string {
+	for _, name := range FunctionNames {
+		if !gr.NameUsed(name) {
+			return name
 		}
-		val := ln.Expr.Integrate(0, args[0].(float64), ln.TimesHit)
-		return val, nil
 	}
-	TheGraph.Functions[functionName+"int"] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+"int", args, "float64", "float64")
-		if err != nil {
-			return 0, err
-		}
-		min := args[0].(float64)
-		max := args[1].(float64)
-		val := ln.Expr.Integrate(min, max, ln.TimesHit)
-		return val, nil
+	return ""
+}
+
+// FunctionNames returns the names of all of the functions that the line adds
+func (ln *Line) FunctionNames() []string {
+	if ln.Name == "" {
+		return nil
+	}
+	n := ln.Name
+	return []string{n, n + "'", n + `"`, strings.ToUpper(n), n + "int", n + "h", n + "sum", n + "psum"}
+}
+
+// CheckLineName returns an error if the given name can not be used for the line with the given index.
+// Lines without a name are allowed, but they can not be used in other expressions.
+func (gr *Graph) CheckLineName(name string, idx int) error {
+	if name == "" {
+		return nil
 	}
-	TheGraph.Functions[functionName+"h"] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+"h", args, "float64")
-		if err != nil {
-			return 0, err
+	for i, r := range name {
+		if !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return fmt.Errorf("line name %q needs to start with a letter and only contain letters and digits", name)
 		}
-		return float64(ln.TimesHit) * args[0].(float64), nil
 	}
-	TheGraph.Functions[functionName+"sum"] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+"sum", args, "float64", "float64")
-		if err != nil {
-			return 0, err
+	if strings.ToUpper(name) == name {
+		return fmt.Errorf("line name %q needs a lowercase letter so that it has a different integral name", name)
+	}
+	ln := &Line{Name: name}
+	for _, fn := range ln.FunctionNames() {
+		if IsBuiltinName(fn) {
+			return fmt.Errorf("line name %q uses the built-in name %q", name, fn)
 		}
-		total := 0.0
-		for i := args[0].(float64); i <= args[1].(float64); i++ {
-			total += (ln.Expr.Eval(i, TheGraph.State.Time, ln.TimesHit))
+		if _, ok := DefaultFunctions[fn]; ok {
+			return fmt.Errorf("line name %q uses the name of the function %q", name, fn)
+		}
+		if gr.Variables.Find(fn) != nil {
+			return fmt.Errorf("line name %q uses the name of the variable %q", name, fn)
 		}
-		return total, nil
+		for i, ol := range gr.Lines {
+			if i != idx && slices.Contains(ol.FunctionNames(), fn) {
+				return fmt.Errorf("line name %q uses the name %q, which is already used by line %q", name, fn, ol.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Env returns the environment for evaluating the line at the given x from an expression
+// that is evaluated in the given environment, which has the same time and state
+func (ln *Line) Env(env *Env, x float64) *Env {
+	return &Env{X: x, T: env.T, H: float64(ln.TimesHit.Load()), State: env.state()}
+}
+
+// AddFunctions adds the functions of the line to the graph functions if it has a name
+func (ln *Line) AddFunctions() {
+	if ln.Name == "" {
+		return
 	}
-	TheGraph.Functions[functionName+"psum"] = func(args ...any) (any, error) {
-		err := CheckArgs(functionName+"psum", args, "float64", "float64")
-		if err != nil {
-			return 0, err
+	functionName := ln.Name
+	TheGraph.Functions[functionName] = &Function{NArgs: 1, Deriv: functionName + "'", Call1: func(env *Env, x float64) float64 {
+		return ln.Expr.EvalEnv(ln.Env(env, x))
+	}}
+	TheGraph.Functions[functionName+"'"] = &Function{NArgs: 1, Deriv: functionName + `"`, Call1: func(env *Env, x float64) float64 {
+		return ln.EvalDeriv(1, ln.Env(env, x))
+	}}
+	TheGraph.Functions[functionName+`"`] = &Function{NArgs: 1, Call1: func(env *Env, x float64) float64 {
+		return ln.EvalDeriv(2, ln.Env(env, x))
+	}}
+	capitalName := strings.ToUpper(functionName)
+	TheGraph.Functions[capitalName] = &Function{NArgs: 1, Deriv: functionName, Call1: func(env *Env, x float64) float64 {
+		return ln.Integral(env, x)
+	}}
+	TheGraph.Functions[functionName+"int"] = &Function{NArgs: 2, Call: func(env *Env, args []float64) float64 {
+		return ln.Expr.Integrate(ln.Env(env, 0), args[0], args[1])
+	}}
+	TheGraph.Functions[functionName+"h"] = &Function{NArgs: 1, Call1: func(env *Env, x float64) float64 {
+		return float64(ln.TimesHit.Load()) * x
+	}}
+	TheGraph.Functions[functionName+"sum"] = &Function{NArgs: 2, Call: func(env *Env, args []float64) float64 {
+		total := 0.0
+		for i := args[0]; i <= args[1]; i++ {
+			total += (ln.Expr.EvalEnv(ln.Env(env, i)))
 		}
+		return total
+	}}
+	TheGraph.Functions[functionName+"psum"] = &Function{NArgs: 2, Call: func(env *Env, args []float64) float64 {
 		total := 1.0
-		for i := args[0].(float64); i <= args[1].(float64); i++ {
-			total *= (ln.Expr.Eval(i, TheGraph.State.Time, ln.TimesHit))
+		for i := args[0]; i <= args[1]; i++ {
+			total *= (ln.Expr.EvalEnv(ln.Env(env, i)))
+		}
+		return total
+	}}
+}
+
+// CompileDerivs compiles the symbolic first and second derivatives of the line with respect to x.
+// Lines with complex values only use central differences, since their values are checked to be real.
+// Some derivatives can not be compiled, like that of abs of a complex value; those use central differences too.
+func (ln *Line) CompileDerivs() {
+	ln.Derivs = [2]*Compiled{}
+	if ln.Expr.Node == nil || ln.Expr.Val == nil || ln.Expr.Val.Kind != KindNumber {
+		return
+	}
+	d := ln.Expr.Node
+	for i := range ln.Derivs {
+		d = Derivative(d, "x", TheGraph.Context())
+		c, err := CompileNode(d, TheGraph.Context())
+		if err != nil || c.Kind != KindNumber {
+			return
+		}
+		ln.Derivs[i] = c
+	}
+}
+
+// EvalDeriv evaluates the derivative of the given order (1 or 2) of the line in the given environment,
+// which has the x to evaluate it at. It uses the symbolic derivative if there is one, and central differences
+// if not or if the symbolic derivative is undefined at x (like the derivative of abs(x) at 0).
+func (ln *Line) EvalDeriv(order int, env *Env) float64 {
+	if d := ln.Derivs[order-1]; d != nil {
+		v := d.Num(env)
+		if !math.IsNaN(v) {
+			return v
 		}
-		return total, nil
 	}
+	formula := fd.Central
+	if order == 2 {
+		formula = fd.Central2nd
+	}
+	e := *env
+	return fd.Derivative(func(x float64) float64 {
+		e.X = x
+		return ln.Expr.EvalEnv(&e)
+	}, env.X, &fd.Settings{
+		Formula: formula,
+	})
 }
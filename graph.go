@@ -5,17 +5,19 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"image/color"
-	"sort"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unicode"
 
 	"cogentcore.org/core/colors"
 	"cogentcore.org/core/core"
 	"cogentcore.org/core/math32"
 	"cogentcore.org/core/parse/complete"
+	"gonum.org/v1/gonum/spatial/r2"
 )
 
 // Graph contains the lines and parameters of a graph
@@ -27,6 +29,12 @@ type Graph struct { //types:add
 	// the lines of the graph -- can have any number
 	Lines Lines
 
+	// the named variables of the graph, which can be used in every expression
+	Variables Variables
+
+	// the helper functions of the graph, which can have any number of parameters and be used in every expression
+	Helpers Helpers
+
 	Marbles []*Marble `json:"-"`
 
 	State State `json:"-"`
@@ -37,36 +45,69 @@ type Graph struct { //types:add
 
 	Objects Objects `json:"-"`
 
-	EvalMu sync.Mutex `json:"-"`
+	// EvalMu is held for reading while expressions are evaluated and for writing while they
+	// are compiled, so that drawing and updating the marbles can evaluate them in parallel
+	EvalMu sync.RWMutex `json:"-"`
+
+	// StateMu protects the marbles and the time, which are updated by the marbles while the graph is drawn
+	StateMu sync.Mutex `json:"-"`
 }
 
 // State has the state of the graph
 type State struct {
-	Running        bool
+	Running        atomic.Bool
 	Time           float64
 	PrevTime       float64
 	Step           int
 	Error          error
 	SelectedMarble int
 	File           core.Filename
+
+	// Eval is the evaluation state for everything in a run that is not about one marble
+	Eval *EvalState
+
+	// NewDiags is whether there are diagnostics from evaluating expressions that are not shown yet
+	NewDiags atomic.Bool
+
+	// Playing is whether [Graph.PlayVariables] is animating the playing slider variables
+	Playing atomic.Bool
+
+	// Crowd is the snapshot of the marbles from the end of the latest step, which expressions use through [CrowdFunctions]
+	Crowd atomic.Pointer[Crowd]
 }
 
 // Line represents one line with an equation etc
 type Line struct {
 
+	// Name is the name of the function for this line, like f or ramp, which can be used
+	// in other expressions along with its derivatives (f', f"), integral (F) and others (fint, fh, fsum, fpsum).
+	// Any expression can use when it was hit with hits(f), hitsSince(f, s), lastHitTime(f) and marbleHits(f).
+	Name string `width:"6"`
+
 	// Equation: use x for the x value, t for the time passed since the marbles were ran (incremented by TimeStep), and a for 10*sin(t) (swinging back and forth version of t)
 	Expr Expr
 
-	// Graph this line if this condition is true. Ex: x>3
+	// Graph this line if this condition is true. Ex: x>3. It can use the [MarbleVars] of the marble
+	// that would hit it, like n%2 == 0 for only every other marble.
 	GraphIf Expr
 
-	// how bouncy the line is -- 1 = perfectly bouncy, 0 = no bounce at all
+	// how bouncy the line is -- 1 = perfectly bouncy, 0 = no bounce at all. It can use the [MarbleVars], like speed.
 	Bounce Expr `min:"0" max:"2" step:".05"`
 
 	// Line color and colorswitch
 	Colors LineColors
 
-	TimesHit int `display:"-" json:"-"`
+	// TimesHit is the number of times the marbles have hit the line
+	TimesHit atomic.Int64 `display:"-" json:"-"`
+
+	// Hits are the times that the marbles have hit the line at
+	Hits HitLog `display:"-" json:"-"`
+
+	// Derivs are the compiled first and second derivatives of Expr with respect to x
+	Derivs [2]*Compiled `display:"-" json:"-"`
+
+	// Diags are the problems with the line that are not in one of its expressions, like an invalid name
+	Diags Diagnostics `display:"-" json:"-"`
 
 	Changes bool `display:"-" json:"-"`
 }
@@ -83,6 +124,10 @@ type Params struct { //types:add
 	// Marble vertical start position
 	MarbleStartY Expr
 
+	// Marble start position as a point, like (10(rand-0.5), 10-2n/nmarbles).
+	// If it is set, it is used instead of MarbleStartX and MarbleStartY.
+	MarbleStart Expr
+
 	// Starting horizontal velocity of the marbles
 	StartVelocityY Param `display:"inline" label:"Starting velocity y"`
 
@@ -98,15 +143,23 @@ type Params struct { //types:add
 	// how fast it accelerates down
 	YForce Param `display:"inline" label:"Y force (Gravity)"`
 
-	// how fast the marbles move side to side without collisions, set to 0 for no movement
+	// how fast the marbles move side to side without collisions, set to 0 for no movement.
+	// The forces can use the [MarbleVars], like -0.01vx for drag.
 	XForce Param `display:"inline" label:"X force (Wind)"`
 
+	// force on the marbles as a vector, like (0, -0.1), which can depend on their position x and y.
+	// If it is set, it is used instead of XForce and YForce.
+	Force Param `display:"inline"`
+
 	// the center point of the graph, x
 	CenterX Param `display:"inline" label:"Graph center x"`
 
 	// the center point of the graph, y
 	CenterY Param `display:"inline" label:"Graph center y"`
 
+	// Random seed: runs with the same seed give the same random values, and each marble has its own random values
+	Seed int64 `label:"Random seed"`
+
 	TrackingSettings TrackingSettings
 }
 
@@ -117,6 +170,9 @@ type Param struct {
 	Changes bool `display:"-" json:"-"`
 
 	BaseVal float64 `display:"-" json:"-"`
+
+	// BaseVec is the value of a point param that does not change
+	BaseVec r2.Vec `display:"-" json:"-"`
 }
 
 // LineColors contains the color and colorswitch for a line
@@ -142,8 +198,14 @@ type Objects struct {
 	Body  *core.Body
 	Graph *core.Canvas
 
-	LinesTable *core.Table
-	ParamsForm *core.Form
+	LinesTable     *core.Table
+	PreviewsFrame  *core.Frame
+	HelpersTable   *core.Table
+	ParamsForm     *core.Form
+	VariablesTable *core.Table
+	SlidersFrame   *core.Frame
+
+	DiagnosticsFrame *core.Frame
 }
 
 // Lines is a collection of lines
@@ -151,11 +213,10 @@ type Lines []*Line
 
 const GraphViewBoxSize = 10
 
-var BasicFunctionList = []string{}
-
 var CompleteWords = []string{}
 
-// FunctionNames has all of the supported function names, in order
+// FunctionNames are the default function names that are given to lines without a name, in order.
+// Lines in files from before lines had names are given these names by their index.
 var FunctionNames = []string{"f", "g", "b", "c", "j", "k", "l", "m", "o", "p", "q", "r", "s", "u", "v", "w"}
 
 // TheGraph is current graph
@@ -181,22 +242,33 @@ func (gr *Graph) Defaults() {
 func (gr *Graph) Graph() { //types:add
 	defer gr.Objects.Graph.NeedsRender()
 
-	if gr.State.Running {
-		gr.Stop()
-	}
-	gr.State.Error = nil
+	gr.Stop()
+	gr.EvalMu.Lock()
+	defer gr.EvalMu.Unlock()
+	gr.clearErr()
 	gr.SetFunctionsTo(DefaultFunctions)
+	gr.ParseHelpers()
 	gr.AddLineFunctions()
+	gr.AddHelperFunctions()
 	gr.CompileExprs()
-	if gr.State.Error != nil {
+	gr.PlayVariables()
+	if gr.Objects.PreviewsFrame != nil {
+		gr.Objects.PreviewsFrame.Update()
+	}
+	if gr.Err() != nil {
+		gr.UpdateDiagnostics()
 		return
 	}
 	gr.ResetMarbles()
+	gr.StateMu.Lock()
 	gr.State.Time = 0
-	if gr.State.Error != nil {
+	gr.StateMu.Unlock()
+	if gr.Err() != nil {
+		gr.UpdateDiagnostics()
 		return
 	}
-	SetCompleteWords(TheGraph.Functions)
+	SetCompleteWords(TheGraph.Functions, TheGraph.Variables)
+	gr.UpdateDiagnostics()
 	// if gr.State.Error == nil {
 	// 	errorText.SetText("Graphed successfully")
 	// }
@@ -204,7 +276,9 @@ func (gr *Graph) Graph() { //types:add
 
 func (gr *Graph) graphAndUpdate() {
 	gr.Graph()
-	gr.Objects.Body.Scene.Update()
+	if gr.Objects.Body != nil {
+		gr.Objects.Body.Scene.Update()
+	}
 }
 
 // Run runs the marbles for NSteps
@@ -215,22 +289,25 @@ func (gr *Graph) Run() { //types:add
 
 // Stop stops the marbles
 func (gr *Graph) Stop() { //types:add
-	gr.State.Running = false
+	gr.State.Running.Store(false)
 }
 
 // Step does one step update of marbles
 func (gr *Graph) Step() { //types:add
-	if gr.State.Running {
+	if gr.State.Running.Load() {
 		return
 	}
 	gr.UpdateMarbles()
-	gr.State.Time += gr.Params.TimeStep.Eval(0, 0)
+	gr.AdvanceTime()
+	if gr.Err() != nil {
+		gr.UpdateDiagnostics()
+	}
 }
 
 // StopSelecting stops selecting current marble
 func (gr *Graph) StopSelecting() { //types:add
 	gr.State.SelectedMarble = -1
-	if !gr.State.Running {
+	if !gr.State.Running.Load() {
 		gr.Objects.Graph.NeedsRender()
 	}
 }
@@ -251,22 +328,42 @@ func (gr *Graph) AddLine() { //types:add
 	} else {
 		color = TheSettings.LineDefaults.LineColors.Color
 	}
-	newLine := &Line{Colors: LineColors{color, TheSettings.LineDefaults.LineColors.ColorSwitch}}
-	gr.Lines = append(gr.Lines, newLine)
+	newLine := &Line{Name: gr.UnusedLineName(), Colors: LineColors{color, TheSettings.LineDefaults.LineColors.ColorSwitch}}
+	gr.edit(func() {
+		gr.Lines = append(gr.Lines, newLine)
+	})
 	gr.Objects.LinesTable.Update()
 }
 
+// edit runs the given function, which changes the lines, variables, helpers or params, while holding
+// [Graph.EvalMu] for writing, so that the running marbles and the drawing do not evaluate them while they change
+func (gr *Graph) edit(f func()) {
+	gr.EvalMu.Lock()
+	defer gr.EvalMu.Unlock()
+	f()
+}
+
 // Reset resets the graph to its starting position (one default line and default params)
 func (gr *Graph) Reset() { //types:add
-	gr.State.File = ""
-	gr.Lines = nil
-	gr.Lines.Defaults()
-	gr.Params.Defaults()
+	gr.Stop()
+	gr.edit(func() {
+		gr.State.File = ""
+		gr.Lines = nil
+		gr.Lines.Defaults()
+		gr.Variables = nil
+		gr.Helpers = nil
+		gr.Params.Defaults()
+	})
 	gr.graphAndUpdate()
 }
 
-// CompileExprs gets the lines of the graph ready for graphing
+// CompileExprs gets the variables and lines of the graph ready for graphing
 func (gr *Graph) CompileExprs() {
+	gr.SetSources()
+	// everything is parsed first so that the circular definitions between the variables,
+	// helpers and lines are found before anything is compiled
+	gr.ParseVariables()
+	gr.ParseHelperBodies()
 	for k, ln := range gr.Lines {
 		ln.Changes = false
 		if ln.Expr.Expr == "" {
@@ -288,91 +385,113 @@ func (gr *Graph) CompileExprs() {
 		if ln.GraphIf.Expr == "" {
 			ln.GraphIf.Expr = TheSettings.LineDefaults.GraphIf
 		}
-		if CheckCircular(ln.Expr.Expr, k) {
-			HandleError(errors.New("circular logic detected"))
-			return
-		}
-		if CheckIfChanges(ln.Expr.Expr) || CheckIfChanges(ln.GraphIf.Expr) || CheckIfChanges(ln.Bounce.Expr) {
-			ln.Changes = true
-		}
-		ln.TimesHit = 0
-		ln.Compile()
+		ln.Expr.Parse()
+	}
+	gr.CheckCycles()
+	// lines that use variables or helpers with errors get their own errors, so it keeps going
+	gr.CompileVariables()
+	gr.CompileHelpers()
+	for _, ln := range gr.Lines {
+		ln.TimesHit.Store(0)
+		ln.Hits.Reset()
+		ln.compile()
+	}
+	// the lines that a line uses need to be compiled to know whether it changes
+	for _, ln := range gr.Lines {
+		d := ln.Deps()
+		ln.Changes = d.Changes()
 	}
 	gr.CompileParams()
 }
 
 // CompileParams compiles all of the graph parameter expressions
 func (gr *Graph) CompileParams() {
-	gr.Params.StartVelocityY.Compile()
-	gr.Params.StartVelocityX.Compile()
-	gr.Params.UpdateRate.Compile()
-	gr.Params.YForce.Compile()
-	gr.Params.XForce.Compile()
-	gr.Params.TimeStep.Compile()
-	gr.Params.CenterX.Compile()
-	gr.Params.CenterY.Compile()
-}
-
-// CheckCircular checks if an expr references itself
-func CheckCircular(expr string, k int) bool {
-	if CheckIfReferences(expr, k) {
-		return true
-	}
-	for i := range FunctionNames {
-		if CheckIfReferences(expr, i) {
-			return CheckCircular(TheGraph.Lines[i].Expr.Expr, k)
-		}
+	gr.Params.CompileStart()
+	for _, pr := range gr.Params.ParamList() {
+		pr.Compile()
 	}
-	return false
+	gr.Params.Force.CompileKind(KindPoint)
 }
 
-// CheckIfReferences checks if an expr references a given function
-func CheckIfReferences(expr string, k int) bool {
-	sort.Slice(BasicFunctionList, func(i, j int) bool {
-		return len(BasicFunctionList[i]) > len(BasicFunctionList[j])
-	})
-	for _, d := range BasicFunctionList {
-		expr = strings.ReplaceAll(expr, d, "")
-	}
-	if k >= len(FunctionNames) || k >= len(TheGraph.Lines) {
-		return false
+// CompileStart compiles the expressions of the start position of the marbles that are used:
+// MarbleStart if it is set, and MarbleStartX and MarbleStartY otherwise
+func (pr *Params) CompileStart() {
+	if pr.MarbleStart.Expr != "" {
+		pr.MarbleStart.Compile()
+		pr.MarbleStart.CheckKind(KindPoint)
+		return
 	}
-	funcName := FunctionNames[k]
-	if strings.Contains(expr, funcName) || strings.Contains(expr, strings.ToUpper(funcName)) {
-		return true
+	pr.MarbleStartX.Compile()
+	pr.MarbleStartX.CheckKind(KindNumber)
+	pr.MarbleStartY.Compile()
+	pr.MarbleStartY.CheckKind(KindNumber)
+}
+
+// ShouldDisplay hides the separate x and y fields when the point fields that replace them are set
+func (pr *Params) ShouldDisplay(field string) bool {
+	switch field {
+	case "MarbleStartX", "MarbleStartY":
+		return pr.MarbleStart.Expr == ""
+	case "XForce", "YForce":
+		return pr.Force.Expr.Expr == ""
 	}
-	return false
+	return true
 }
 
-// CheckIfChanges checks if an equation changes over time
-func CheckIfChanges(expr string) bool {
-	for _, d := range BasicFunctionList {
-		expr = strings.ReplaceAll(expr, d, "")
-	}
-	if strings.Contains(expr, "a") || strings.Contains(expr, "h") || strings.Contains(expr, "t") {
-		return true
-	}
-	for k := range FunctionNames {
-		if CheckIfReferences(expr, k) {
-			return CheckIfChanges(TheGraph.Lines[k].Expr.Expr)
-		}
+// ParamList returns all of the params that are a [Param]
+func (pr *Params) ParamList() []*Param {
+	return []*Param{&pr.StartVelocityY, &pr.StartVelocityX, &pr.UpdateRate, &pr.YForce, &pr.XForce, &pr.TimeStep, &pr.CenterX, &pr.CenterY}
+}
+
+// ExprFields returns all of the expressions of the params along with the names of their fields
+func (pr *Params) ExprFields() ([]string, []*Expr) {
+	names := []string{"MarbleStartX", "MarbleStartY", "MarbleStart", "StartVelocityY", "StartVelocityX", "UpdateRate", "YForce", "XForce", "TimeStep", "CenterX", "CenterY", "Force"}
+	exprs := []*Expr{&pr.MarbleStartX, &pr.MarbleStartY, &pr.MarbleStart}
+	for _, p := range pr.ParamList() {
+		exprs = append(exprs, &p.Expr)
 	}
-	return false
+	exprs = append(exprs, &pr.Force.Expr)
+	return names, exprs
 }
 
-// InitBasicFunctionList adds all of the basic functions to a list
-func InitBasicFunctionList() {
-	for k := range DefaultFunctions {
-		BasicFunctionList = append(BasicFunctionList, k)
+// Deps returns everything that the expressions of the line use, directly or through the lines, helpers and variables that they use
+func (ln *Line) Deps() Deps {
+	d := TheGraph.DirectDeps(ln.Expr.Node)
+	TheGraph.addDeps(&d, ln.GraphIf.Node, nil)
+	TheGraph.addDeps(&d, ln.Bounce.Node, nil)
+	TheGraph.followDeps(&d)
+	return d
+}
+
+// checkMarbleVars reports the [MarbleVars] that the expression of the line uses, directly or through
+// what it calls, which are always 0 there since the expression is not evaluated for a marble
+func (ln *Line) checkMarbleVars() {
+	if ln.Expr.Val == nil {
+		return
+	}
+	d := TheGraph.ExprDeps(ln.Expr.Node)
+	names := slices.DeleteFunc(d.Vars, func(v string) bool { return !slices.Contains(MarbleVars, v) })
+	if len(names) > 0 {
+		ln.Expr.Report(fmt.Errorf("%v is always 0 in the expression of a line; marble variables can only be used in the params and the GraphIf and Bounce of lines", strings.Join(names, ", ")))
 	}
-	BasicFunctionList = append(BasicFunctionList, "true", "false")
 }
 
 // Compile compiles all of the expressions in a line
 func (ln *Line) Compile() {
-	ln.Expr.Compile()
+	ln.Expr.Parse()
+	ln.compile()
+}
+
+// compile compiles all of the expressions in a line after its Expr has been parsed
+func (ln *Line) compile() {
+	ln.Expr.CompileParsed()
+	ln.Expr.CheckKind(KindNumber)
+	ln.checkMarbleVars()
+	ln.CompileDerivs()
 	ln.Bounce.Compile()
+	ln.Bounce.CheckKind(KindNumber)
 	ln.GraphIf.Compile()
+	ln.GraphIf.CheckKind(KindBool)
 }
 
 // Defaults sets the line to the defaults specified in settings
@@ -391,7 +510,7 @@ func (ln *Line) Defaults(lidx int) {
 // Defaults makes the lines and then defaults them
 func (ls *Lines) Defaults() {
 	*ls = make(Lines, 1, 10)
-	ln := Line{}
+	ln := Line{Name: FunctionNames[0]}
 	(*ls)[0] = &ln
 	ln.Defaults(0)
 
@@ -402,14 +521,17 @@ func (pr *Params) Defaults() {
 	pr.NMarbles = TheSettings.GraphDefaults.NMarbles
 	pr.MarbleStartX = TheSettings.GraphDefaults.MarbleStartX
 	pr.MarbleStartY = TheSettings.GraphDefaults.MarbleStartY
+	pr.MarbleStart = TheSettings.GraphDefaults.MarbleStart
 	pr.StartVelocityY = TheSettings.GraphDefaults.StartVelocityY
 	pr.StartVelocityX = TheSettings.GraphDefaults.StartVelocityX
 	pr.UpdateRate = TheSettings.GraphDefaults.UpdateRate
 	pr.YForce = TheSettings.GraphDefaults.YForce
 	pr.XForce = TheSettings.GraphDefaults.XForce
+	pr.Force = TheSettings.GraphDefaults.Force
 	pr.TimeStep = TheSettings.GraphDefaults.TimeStep
 	pr.CenterX = TheSettings.GraphDefaults.CenterX
 	pr.CenterY = TheSettings.GraphDefaults.CenterY
+	pr.Seed = TheSettings.GraphDefaults.Seed
 	pr.TrackingSettings = TheSettings.GraphDefaults.TrackingSettings
 }
 
@@ -429,23 +551,38 @@ func (pr *Params) BasicDefaults() {
 	pr.TrackingSettings.Defaults()
 }
 
-// Eval evaluates a parameter
-func (pr *Param) Eval(x, y float64) float64 {
+// Eval evaluates a parameter in the given environment
+func (pr *Param) Eval(env *Env) float64 {
 	if !pr.Changes {
 		return pr.BaseVal
 	}
-	return pr.Expr.EvalWithY(x, TheGraph.State.Time, 0, y)
+	return pr.Expr.EvalEnv(env)
+}
+
+// EvalVec evaluates a point parameter in the given environment
+func (pr *Param) EvalVec(env *Env) r2.Vec {
+	if !pr.Changes {
+		return pr.BaseVec
+	}
+	return pr.Expr.EvalPoint(env)
 }
 
 // Compile compiles evalexpr and sets changes
 func (pr *Param) Compile() {
+	pr.CompileKind(KindNumber)
+}
+
+// CompileKind compiles the param as the given kind of value, either a float64 value or a point
+func (pr *Param) CompileKind(kind Kind) {
 	pr.Expr.Compile()
-	expr := pr.Expr.Expr
-	for _, d := range BasicFunctionList {
-		expr = strings.ReplaceAll(expr, d, "")
+	pr.Expr.CheckKind(kind)
+	d := TheGraph.ExprDeps(pr.Expr.Node)
+	pr.Changes = d.Changes() || d.Uses("x", "y") || d.Uses(MarbleVars...)
+	if pr.Changes {
+		return
 	}
-	if CheckIfChanges(expr) || strings.Contains(expr, "x") || strings.Contains(expr, "y") {
-		pr.Changes = true
+	if kind == KindPoint {
+		pr.BaseVec = pr.Expr.EvalPoint(&Env{})
 	} else {
 		pr.BaseVal = pr.Expr.Eval(0, 0, 0)
 	}
@@ -465,6 +602,10 @@ func ExprComplete(data any, text string, posLn, posCh int) (md complete.Matches)
 	possibles := complete.MatchSeedString(CompleteWords, md.Seed)
 	for _, p := range possibles {
 		m := complete.Completion{Text: p, Icon: ""}
+		if fn, ok := TheGraph.Functions[p]; ok {
+			m.Label = fn.Signature(p)
+			m.Desc = fn.Doc
+		}
 		md.Matches = append(md.Matches, m)
 	}
 	return md
@@ -477,10 +618,21 @@ func ExprCompleteEdit(data any, text string, cursorPos int, completion complete.
 }
 
 // SetCompleteWords sets the words used for complete in the expressions
-func SetCompleteWords(functions Functions) {
+func SetCompleteWords(functions Functions, variables Variables) {
 	CompleteWords = []string{}
-	for k := range functions {
-		CompleteWords = append(CompleteWords, k)
+	for k, fn := range functions {
+		if !fn.Internal {
+			CompleteWords = append(CompleteWords, k)
+		}
 	}
+	for _, v := range variables {
+		CompleteWords = append(CompleteWords, v.Name)
+	}
+	CompleteWords = append(CompleteWords, SpecialForms...)
 	CompleteWords = append(CompleteWords, "true", "false", "pi", "a", "t")
+	for _, v := range MarbleVars {
+		if v != "n" { // n is usually the index of a sequence, which is already a word where it is used
+			CompleteWords = append(CompleteWords, v)
+		}
+	}
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Helper is a function with any number of named parameters that can be used in every expression of the graph.
+// A helper with one parameter can also be a sequence that refers to its earlier terms, like u(n) = u(n-1)*r + 1,
+// with base cases defined by other helpers, like u(0) = 1.
+type Helper struct {
+
+	// Definition of the function, like bump(x, c, w) = exp(-((x-c)/w)^2), or a base case of a sequence, like u(0) = 1.
+	// The body can use its parameters, t, variables, line functions and other helpers.
+	Def string `width:"40"`
+
+	// Name is the name of the function, parsed from Def
+	Name string `display:"-" json:"-"`
+
+	// Params are the names of the parameters of the function, parsed from Def
+	Params []string `display:"-" json:"-"`
+
+	// Node is the syntax tree of the body of the function
+	Node Node `display:"-" json:"-"`
+
+	// Val is the compiled body of the function
+	Val *Compiled `display:"-" json:"-"`
+
+	// Diags are the problems with the definition of the function
+	Diags Diagnostics `display:"-" json:"-"`
+
+	// IsBase is whether the helper is a base case of a sequence, like u(0) = 1, instead of a function
+	IsBase bool `display:"-" json:"-"`
+
+	// Index is the index of the base case if IsBase, like 0 in u(0) = 1
+	Index float64 `display:"-" json:"-"`
+
+	// Bases are the base cases of the sequence that the helper defines, if there are any
+	Bases Helpers `display:"-" json:"-"`
+
+	// Recursive is whether the body of the helper calls the helper itself
+	Recursive bool `display:"-" json:"-"`
+
+	// body is the body of Def, with the head replaced by spaces so that columns match Def
+	body string
+}
+
+// Helpers is a collection of helper functions
+type Helpers []*Helper
+
+// Find returns the helper with the given name that is not a base case, or nil if there is none
+func (hs Helpers) Find(name string) *Helper {
+	for _, h := range hs {
+		if h.Name == name && !h.IsBase {
+			return h
+		}
+	}
+	return nil
+}
+
+// ParseDef parses the name, parameters and body of the definition of the helper
+func (h *Helper) ParseDef() error {
+	h.Name, h.Params, h.body, h.IsBase, h.Index = "", nil, "", false, 0
+	src := []rune(h.Def)
+	open := slices.Index(src, '(')
+	closing := slices.Index(src, ')')
+	if open < 0 || closing < open {
+		return &SyntaxError{0, len(src), "a helper function needs a definition like name(x, y) = expression"}
+	}
+	eq := closing + 1
+	for eq < len(src) && unicode.IsSpace(src[eq]) {
+		eq++
+	}
+	if eq >= len(src) || src[eq] != '=' {
+		return &SyntaxError{closing + 1, len(src), "expected = after the parameters"}
+	}
+	h.Name = strings.TrimSpace(string(src[:open]))
+	params := strings.Split(string(src[open+1:closing]), ",")
+	for _, p := range params {
+		p = strings.TrimSpace(p)
+		if idx, err := strconv.ParseFloat(p, 64); err == nil && len(params) == 1 {
+			h.IsBase, h.Index = true, idx
+			continue
+		}
+		if !isDefName(p) || p == "true" || p == "false" || slices.Contains(SpecialForms, p) {
+			return &SyntaxError{open + 1, closing, fmt.Sprintf("invalid parameter name %q", p)}
+		}
+		if slices.Contains(h.Params, p) {
+			return &SyntaxError{open + 1, closing, fmt.Sprintf("there are multiple parameters named %q", p)}
+		}
+		h.Params = append(h.Params, p)
+	}
+	h.body = strings.Repeat(" ", eq+1) + string(src[eq+1:])
+	return nil
+}
+
+// isDefName returns whether the given name starts with a letter and only contains letters and digits
+func isDefName(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// ParseHelpers parses the definitions of the helpers
+func (gr *Graph) ParseHelpers() {
+	for _, h := range gr.Helpers {
+		h.Node, h.Val, h.Diags, h.Bases, h.Recursive = nil, nil, nil, nil, false
+		if err := h.ParseDef(); err != nil {
+			h.Report(err)
+			h.Name = ""
+		}
+	}
+}
+
+// AddHelperFunctions checks the names of the parsed helpers and adds them to the graph
+// functions so that every expression can call them, and adds the base cases to their sequences.
+// Their bodies are compiled later by [Graph.CompileHelpers].
+func (gr *Graph) AddHelperFunctions() {
+	for i, h := range gr.Helpers {
+		if h.Name == "" || len(h.Diags) > 0 || h.IsBase {
+			continue
+		}
+		if err := gr.CheckHelperName(h.Name, i); err != nil {
+			h.Report(err)
+			continue
+		}
+		gr.Functions[h.Name] = h.Function()
+	}
+	for _, b := range gr.Helpers {
+		if b.Name == "" || len(b.Diags) > 0 || !b.IsBase {
+			continue
+		}
+		if err := gr.AddBase(b); err != nil {
+			b.Report(err)
+		}
+	}
+}
+
+// AddBase adds the given base case to the sequence with its name
+func (gr *Graph) AddBase(b *Helper) error {
+	h := gr.Helpers.Find(b.Name)
+	switch {
+	case h == nil:
+		return fmt.Errorf("base case %v needs a definition of the sequence, like %v(n) = %v(n-1) + 1", b.Label(), b.Name, b.Name)
+	case len(h.Diags) > 0:
+		return fmt.Errorf("the definition of the sequence %v has problems", b.Name)
+	case len(h.Params) != 1:
+		return fmt.Errorf("base case %v needs %v to have one parameter, not %v", b.Label(), b.Name, len(h.Params))
+	}
+	for _, ob := range h.Bases {
+		if ob.Index == b.Index {
+			return fmt.Errorf("there are multiple base cases for %v", b.Label())
+		}
+	}
+	h.Bases = append(h.Bases, b)
+	return nil
+}
+
+// Label returns the name of the helper, like u, or u(0) for a base case
+func (h *Helper) Label() string {
+	switch {
+	case h.Name == "":
+		return h.Def
+	case h.IsBase:
+		return fmt.Sprintf("%v(%v)", h.Name, h.Index)
+	}
+	return h.Name
+}
+
+// Report adds a diagnostic for the given error to the helper
+func (h *Helper) Report(err error) {
+	h.Diags = append(h.Diags, NewDiagnostic(Diagnostic{Line: -1, Name: h.Label(), Field: "Helper"}, err))
+}
+
+// Warn adds a diagnostic for a problem found while evaluating the helper, unless it already has one there
+func (h *Helper) Warn(err error) {
+	d := NewDiagnostic(Diagnostic{Line: -1, Name: h.Label(), Field: "Helper"}, err)
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	if !h.Diags.Has(d) {
+		h.Diags = append(h.Diags, d)
+		TheGraph.State.NewDiags.Store(true)
+	}
+}
+
+// CheckHelperName returns an error if the given name can not be used for the helper with the given index
+func (gr *Graph) CheckHelperName(name string, idx int) error {
+	if !isDefName(name) {
+		return fmt.Errorf("helper name %q needs to start with a letter and only contain letters and digits", name)
+	}
+	if IsBuiltinName(name) {
+		return fmt.Errorf("helper name %q is already a built-in name", name)
+	}
+	if _, ok := DefaultFunctions[name]; ok {
+		return fmt.Errorf("helper name %q is already the name of a function", name)
+	}
+	if gr.Variables.Find(name) != nil {
+		return fmt.Errorf("helper name %q is already the name of a variable", name)
+	}
+	for _, ln := range gr.Lines {
+		if slices.Contains(ln.FunctionNames(), name) {
+			return fmt.Errorf("helper name %q is already used by line %q", name, ln.Name)
+		}
+	}
+	for i, h := range gr.Helpers {
+		if i != idx && h.Name == name && !h.IsBase {
+			return fmt.Errorf("there are multiple helpers named %q", name)
+		}
+	}
+	return nil
+}
+
+// Function returns the function that calls the helper
+func (h *Helper) Function() *Function {
+	return &Function{
+		NArgs: len(h.Params),
+		Call: func(env *Env, args []float64) float64 {
+			if h.Val == nil {
+				return math.NaN()
+			}
+			if h.Recursive || len(h.Bases) > 0 {
+				return h.Term(env, args[0])
+			}
+			// the arguments are swapped in instead of copying the environment, which would allocate
+			prev := env.Args
+			env.Args = args
+			v := h.Val.Num(env)
+			env.Args = prev
+			return v
+		},
+		Expand: h.Expand,
+		Params: h.Params,
+	}
+}
+
+// Expand returns the body of the helper with the given arguments in place of its parameters,
+// or nil if the body has not been compiled or the helper is a sequence
+func (h *Helper) Expand(args []Node) Node {
+	if h.Node == nil || len(args) != len(h.Params) || h.Recursive || len(h.Bases) > 0 {
+		return nil
+	}
+	vars := map[string]Node{}
+	for i, p := range h.Params {
+		vars[p] = args[i]
+	}
+	return Substitute(h.Node, vars)
+}
+
+// Context returns the context that the body of the helper is compiled in
+func (h *Helper) Context() *Context {
+	cx := TheGraph.Context()
+	cx.Locals = h.Params
+	cx.Warn = h.Warn
+	return cx
+}
+
+// CompileHelpers compiles the bodies of the helpers from [Graph.ParseHelperBodies], after checking that they do not call each other in a circle.
+// It returns the first error, after reporting the errors of all of the helpers.
+func (gr *Graph) CompileHelpers() error {
+	var first error
+	if err := gr.CheckHelperCycles(); err != nil {
+		first = err
+	}
+	for _, h := range gr.Helpers {
+		if h.Node == nil {
+			continue
+		}
+		if err := h.Compile(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ParseHelperBodies parses the bodies of the helpers with valid definitions. It returns the first error.
+func (gr *Graph) ParseHelperBodies() error {
+	var first error
+	for _, h := range gr.Helpers {
+		if h.Name == "" || len(h.Diags) > 0 {
+			continue
+		}
+		h.Node = nil
+		h.Val = nil
+		cx := h.Context()
+		node, err := ParseExpr(h.body, cx.Scope())
+		if err != nil {
+			h.Report(err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		h.Node = node
+	}
+	for _, h := range gr.Helpers {
+		h.Recursive = h.Node != nil && !h.IsBase && slices.Contains(gr.Calls(h.Node), h.Name)
+	}
+	return first
+}
+
+// Compile compiles the body of the helper from its syntax tree
+func (h *Helper) Compile() error {
+	val, err := CompileNode(h.Node, h.Context())
+	if err == nil && val.Kind != KindNumber {
+		err = compileError(h.Node, "the body needs to be a float64 value, not a %v value", val.Kind)
+	}
+	if err != nil {
+		h.Report(err)
+		return err
+	}
+	h.Val = val
+	memoGen++
+	return nil
+}
+
+// CheckHelperCycles reports an error for the helpers that call themselves, directly or through other helpers,
+// and removes their syntax trees so that they are not compiled. Sequences that call themselves directly and have
+// base cases are well-founded, like u(n) = u(n-1)*r + 1 with u(0) = 1, so they are allowed. It returns the first error.
+func (gr *Graph) CheckHelperCycles() error {
+	state := map[string]int{} // 1 = visiting, 2 = done
+	var cycle []string
+	var visit func(h *Helper, path []string) error
+	visit = func(h *Helper, path []string) error {
+		switch state[h.Name] {
+		case 1:
+			cycle = append(path[slices.Index(path, h.Name):], h.Name)
+			return fmt.Errorf("circular helper definitions: %v", strings.Join(cycle, " -> "))
+		case 2:
+			return nil
+		}
+		state[h.Name] = 1
+		var err error
+		check := func(n Node) bool {
+			name, ok := calledName(n)
+			if !ok || err != nil {
+				return err == nil
+			}
+			if name == h.Name && len(h.Bases) > 0 {
+				return true
+			}
+			if name == h.Name {
+				cycle = []string{h.Name}
+				err = fmt.Errorf("helper %v calls itself, so it needs a base case, like %v(0) = 1", h.Name, h.Name)
+			} else if oh := gr.Helpers.Find(name); oh != nil && oh.Node != nil {
+				err = visit(oh, append(path, h.Name))
+			}
+			return err == nil
+		}
+		Walk(h.Node, check)
+		for _, b := range h.Bases {
+			if b.Node != nil {
+				Walk(b.Node, check)
+			}
+		}
+		state[h.Name] = 2
+		return err
+	}
+	var first error
+	for _, h := range gr.Helpers {
+		if h.Node == nil || h.IsBase {
+			continue
+		}
+		err := visit(h, nil)
+		if err == nil {
+			continue
+		}
+		for _, name := range cycle {
+			if ch := gr.Helpers.Find(name); ch != nil && ch.Node != nil {
+				ch.Report(err)
+				ch.Node = nil
+			}
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Calls returns the names of the functions that the given syntax tree calls or refers to,
+// including the functions called by the helpers that it calls and their base cases
+func (gr *Graph) Calls(n Node) []string {
+	names := []string{}
+	var add func(n Node)
+	add = func(n Node) {
+		Walk(n, func(n Node) bool {
+			name, ok := calledName(n)
+			if !ok || slices.Contains(names, name) {
+				return true
+			}
+			names = append(names, name)
+			if h := gr.Helpers.Find(name); h != nil && h.Node != nil {
+				add(h.Node)
+				for _, b := range h.Bases {
+					if b.Node != nil {
+						add(b.Node)
+					}
+				}
+			}
+			return true
+		})
+	}
+	add(n)
+	return names
+}
+
+// calledName returns the name of the function that the node calls or refers to, if it is a [CallNode] or [FuncNode]
+func calledName(n Node) (string, bool) {
+	switch n := n.(type) {
+	case *CallNode:
+		return n.Name, true
+	case *FuncNode:
+		return n.Name, true
+	}
+	return "", false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// maxHitLog is the largest number of distinct times that a [HitLog] keeps
+const maxHitLog = 100_000
+
+// HitLog records when the marbles have hit a line, which expressions use through functions like hitsSince(f, s).
+// It assumes that time goes forward, so the times are in order. It only keeps the latest [maxHitLog] times,
+// so a window that goes back past the oldest of them counts all of the hits.
+type HitLog struct {
+	mu sync.Mutex
+
+	// times are the distinct times that the line was hit at, in order
+	times []float64
+
+	// totals are the numbers of hits up to and including each of the times
+	totals []int64
+}
+
+// Add records a hit at the given time
+func (hl *HitLog) Add(t float64) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	n := len(hl.times)
+	if n > 0 && hl.times[n-1] == t {
+		hl.totals[n-1]++
+		return
+	}
+	total := int64(1)
+	if n > 0 {
+		total += hl.totals[n-1]
+	}
+	if n >= maxHitLog {
+		// the totals are still counted from the first hit, so only the oldest times are dropped
+		hl.times = slices.Delete(hl.times, 0, n/2)
+		hl.totals = slices.Delete(hl.totals, 0, n/2)
+	}
+	hl.times = append(hl.times, t)
+	hl.totals = append(hl.totals, total)
+}
+
+// Reset removes all of the hits
+func (hl *HitLog) Reset() {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	hl.times, hl.totals = nil, nil
+}
+
+// Since returns the number of hits after the given time
+func (hl *HitLog) Since(t float64) int64 {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	n := len(hl.times)
+	if n == 0 {
+		return 0
+	}
+	i := sort.Search(n, func(i int) bool { return hl.times[i] > t })
+	if i == 0 {
+		return hl.totals[n-1]
+	}
+	return hl.totals[n-1] - hl.totals[i-1]
+}
+
+// Last returns the time of the latest hit, or NaN if there are no hits
+func (hl *HitLog) Last() float64 {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if len(hl.times) == 0 {
+		return math.NaN()
+	}
+	return hl.times[len(hl.times)-1]
+}
+
+// LineArg is a line passed by name as an argument, like f in hits(f), along with its index in the lines
+type LineArg struct {
+	*Line
+	Index int
+}
+
+// compileLinesCall compiles a call to a function with [Function.Lines], like hits(f)
+func compileLinesCall(n *CallNode, fn *Function, cx *Context) (*Compiled, error) {
+	lines := make([]LineArg, fn.Lines)
+	for i, a := range n.Args[:fn.Lines] {
+		name, ok := funcRef(a)
+		k := slices.IndexFunc(cx.Lines, func(ln *Line) bool { return ln.Name == name })
+		if !ok || k < 0 {
+			return nil, compileError(a, "argument %v of %v needs to be the name of a line, like f", i, n.Name)
+		}
+		lines[i] = LineArg{cx.Lines[k], k}
+	}
+	args := make([]func(env *Env) float64, len(n.Args)-fn.Lines)
+	for i, a := range n.Args[fn.Lines:] {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind != KindNumber {
+			return nil, compileError(a, "function %v needs float64 arguments, not a %v value for argument %v", n.Name, c.Kind, i+fn.Lines)
+		}
+		args[i] = c.Num
+	}
+	call := fn.CallLines
+	return &Compiled{Kind: KindNumber, Num: func(env *Env) float64 {
+		st := env.state()
+		vals, top := st.pushArgs(len(args))
+		for i, arg := range args {
+			vals[i] = arg(env)
+		}
+		v := call(env, lines, vals)
+		st.popArgs(top)
+		return v
+	}}, nil
+}
+
+// Hits returns the number of times the marbles have hit the line
+func Hits(env *Env, lines []LineArg, args []float64) float64 {
+	return float64(lines[0].TimesHit.Load())
+}
+
+// HitsSince returns the number of times the marbles have hit the line in the last args[0] of time
+func HitsSince(env *Env, lines []LineArg, args []float64) float64 {
+	return float64(lines[0].Hits.Since(env.T - args[0]))
+}
+
+// LastHitTime returns the time that the marbles last hit the line, or NaN if they have not hit it
+func LastHitTime(env *Env, lines []LineArg, args []float64) float64 {
+	return lines[0].Hits.Last()
+}
+
+// MarbleHits returns the number of times the marble of the environment has hit the line
+func MarbleHits(env *Env, lines []LineArg, args []float64) float64 {
+	if k := lines[0].Index; k < len(env.Hits) {
+		return float64(env.Hits[k])
+	}
+	return 0
+}
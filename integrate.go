@@ -0,0 +1,177 @@
+package main
+
+import "math"
+
+// IntegralSettings are the settings for how accurately integrals are evaluated
+type IntegralSettings struct {
+
+	// the relative error that integrals can have
+	Tolerance float64 `min:"0" label:"Relative tolerance"`
+
+	// the absolute error that integrals can have, which matters for integrals that are about 0
+	AbsTolerance float64 `min:"0" label:"Absolute tolerance"`
+
+	// the largest number of pieces an integral is split into, which limits how long it can take
+	MaxIntervals int `min:"1" max:"10000" label:"Max intervals"`
+}
+
+// Defaults sets the integral settings to their defaults
+func (is *IntegralSettings) Defaults() {
+	is.Tolerance = 1e-8
+	is.AbsTolerance = 1e-10
+	is.MaxIntervals = 500
+}
+
+// The nodes and weights of 15 point Gauss–Kronrod quadrature on [-1, 1], for the nodes
+// from the largest to 0. The 7 point Gauss rule uses the odd nodes.
+var (
+	kronrodNodes = [8]float64{
+		0.991455371120812639206854697526329, 0.949107912342758524526189684047851,
+		0.864864423359769072789712788640926, 0.741531185599394439863864773280788,
+		0.586087235467691130294144845693013, 0.405845151377397166906606412076961,
+		0.207784955007898467600689403773245, 0,
+	}
+	kronrodWeights = [8]float64{
+		0.022935322010529224963732008058970, 0.063092092629978553290700663189204,
+		0.104790010322250183839876322541518, 0.140653259715525918745189590510238,
+		0.169004726639267902826583426598550, 0.190350578064785409913256402421014,
+		0.204432940075298892414161999234649, 0.209482141084727828012999174891714,
+	}
+	gaussWeights = [4]float64{
+		0.129484966168869693270611432679082, 0.279705391489276667901467771423780,
+		0.381830050505118944950369775488975, 0.417959183673469387755102040816327,
+	}
+)
+
+// gaussKronrod returns the integral of f from a to b with 15 point Gauss–Kronrod quadrature,
+// and an estimate of its error, which is the difference from 7 point Gauss quadrature
+func gaussKronrod(f func(x float64) float64, a, b float64) (float64, float64) {
+	c, h := (a+b)/2, (b-a)/2
+	fc := f(c)
+	k, g := kronrodWeights[7]*fc, gaussWeights[3]*fc
+	for i, x := range kronrodNodes[:7] {
+		v := f(c-h*x) + f(c+h*x)
+		k += kronrodWeights[i] * v
+		if i%2 == 1 {
+			g += gaussWeights[i/2] * v
+		}
+	}
+	return k * h, math.Abs((k - g) * h)
+}
+
+// IntegrateFunc returns the integral of the given function from min to max, which can be infinite.
+// It uses adaptive Gauss–Kronrod quadrature, splitting the piece with the largest error in half
+// until the error is within the [IntegralSettings] of [TheSettings].
+func IntegrateFunc(f func(x float64) float64, min, max float64) float64 {
+	switch {
+	case math.IsNaN(min) || math.IsNaN(max):
+		return math.NaN()
+	case min == max:
+		return 0
+	case min > max:
+		return -IntegrateFunc(f, max, min)
+	case math.IsInf(min, -1) && math.IsInf(max, 1):
+		return IntegrateFunc(f, min, 0) + IntegrateFunc(f, 0, max)
+	case math.IsInf(max, 1):
+		// x = min + t/(1-t) for t from 0 to 1
+		return integrateAdaptive(func(t float64) float64 {
+			return f(min+t/(1-t)) / ((1 - t) * (1 - t))
+		}, 0, 1)
+	case math.IsInf(min, -1):
+		// x = max - (1-t)/t for t from 0 to 1
+		return integrateAdaptive(func(t float64) float64 {
+			return f(max-(1-t)/t) / (t * t)
+		}, 0, 1)
+	case math.IsInf(min, 0) || math.IsInf(max, 0):
+		return math.NaN()
+	}
+	return integrateAdaptive(f, min, max)
+}
+
+// integrateAdaptive returns the integral of f from a to b, which are finite and a < b
+func integrateAdaptive(f func(x float64) float64, a, b float64) float64 {
+	type piece struct {
+		a, b, val, err float64
+	}
+	is := TheSettings.IntegralSettings
+	if is.MaxIntervals <= 0 {
+		is.Defaults()
+	}
+	val, err := gaussKronrod(f, a, b)
+	pieces := []piece{{a, b, val, err}}
+	for len(pieces) < is.MaxIntervals {
+		if math.IsNaN(val) || math.IsInf(val, 0) || err <= max(is.AbsTolerance, is.Tolerance*math.Abs(val)) {
+			break
+		}
+		worst := 0
+		for i, p := range pieces {
+			if p.err > pieces[worst].err {
+				worst = i
+			}
+		}
+		p := pieces[worst]
+		mid := (p.a + p.b) / 2
+		if mid <= p.a || mid >= p.b { // the piece can not be split any more
+			break
+		}
+		lv, le := gaussKronrod(f, p.a, mid)
+		rv, re := gaussKronrod(f, mid, p.b)
+		pieces[worst] = piece{p.a, mid, lv, le}
+		pieces = append(pieces, piece{mid, p.b, rv, re})
+		val += lv + rv - p.val
+		err += le + re - p.err
+	}
+	total := 0.0
+	for _, p := range pieces {
+		total += p.val
+	}
+	return total
+}
+
+// maxIntegralCache is the default [EvalState.MaxIntegrals], which is enough for drawing the lines
+const maxIntegralCache = 100_000
+
+// marbleIntegralCache is the [EvalState.MaxIntegrals] of the marbles, which almost never evaluate F(x)
+// at the same x twice, so they only keep a few values along with the last one
+const marbleIntegralCache = 16
+
+// integralCache has the values of the cumulative integral F(x) of a line that have been evaluated in an
+// [EvalState], which are valid while the line, the time if the line changes over time, and the times it was hit are the same
+type integralCache struct {
+	gen  int
+	time float64
+	hits float64
+	vals map[float64]float64
+
+	// lastX is the last x that F(x) was evaluated at, with the value lastF
+	lastX, lastF float64
+}
+
+// Integral returns the cumulative integral of the line from 0 to x in the given environment, which is F(x)
+// for a line named f. The values are cached in the state of the environment, and new values are found from
+// the last one when it is closer than 0, so that evaluating F(x) at a sequence of x values, like when it is
+// drawn, only integrates each piece once.
+func (ln *Line) Integral(env *Env, x float64) float64 {
+	e := ln.Env(env, x)
+	if !ln.Changes {
+		e.T = 0
+	}
+	st := e.state()
+	c := st.ints[ln]
+	if c == nil || c.gen != memoGen || c.time != e.T || c.hits != e.H || len(c.vals) >= st.MaxIntegrals {
+		c = &integralCache{gen: memoGen, time: e.T, hits: e.H, vals: map[float64]float64{}}
+		st.ints[ln] = c
+	}
+	if v, ok := c.vals[x]; ok {
+		return v
+	}
+	var v float64
+	if len(c.vals) > 0 && !math.IsNaN(c.lastF) && !math.IsInf(c.lastF, 0) && math.Abs(x-c.lastX) < math.Abs(x) {
+		v = c.lastF + ln.Expr.Integrate(e, c.lastX, x)
+	} else {
+		v = ln.Expr.Integrate(e, 0, x)
+	}
+	c.vals[x] = v
+	c.lastX, c.lastF = x, v
+	return v
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
 
 	"cogentcore.org/core/base/iox/jsonx"
@@ -19,7 +21,21 @@ func (gr *Graph) SaveLast() { //types:add
 
 // OpenJSON opens a graph from a JSON file
 func (gr *Graph) OpenJSON(filename core.Filename) error { //types:add
-	err := jsonx.Open(gr, string(filename))
+	gr.Stop()
+	var err error
+	gr.edit(func() {
+		// the lines are decoded into new lines, or they would keep the names of the current ones
+		gr.Lines = nil
+		gr.Variables = nil // older files do not have variables or helpers
+		gr.Helpers = nil
+		gr.Params.MarbleStart = Expr{} // or the newer params
+		gr.Params.Force = Param{}
+		gr.Params.Seed = 0
+		err = jsonx.Open(gr, string(filename))
+		if err == nil {
+			gr.nameLegacyLines(string(filename))
+		}
+	})
 	if HandleError(err) {
 		return err
 	}
@@ -30,7 +46,16 @@ func (gr *Graph) OpenJSON(filename core.Filename) error { //types:add
 
 // OpenAutoSave opens the last graphed graph, stays between sessions of the app
 func (gr *Graph) OpenAutoSave() error {
-	err := jsonx.Open(gr, filepath.Join(core.TheApp.AppDataDir(), "autosave.json"))
+	filename := filepath.Join(core.TheApp.AppDataDir(), "autosave.json")
+	gr.Stop()
+	var err error
+	gr.edit(func() {
+		gr.Lines = nil
+		err = jsonx.Open(gr, filename)
+		if err == nil {
+			gr.nameLegacyLines(filename)
+		}
+	})
 	if HandleError(err) {
 		return err
 	}
@@ -38,6 +63,27 @@ func (gr *Graph) OpenAutoSave() error {
 	return nil
 }
 
+// nameLegacyLines names the lines with [Graph.NameLines] if the given file was saved
+// before lines had names, which is when none of its lines have a Name
+func (gr *Graph) nameLegacyLines(filename string) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var file struct {
+		Lines []map[string]json.RawMessage
+	}
+	if json.Unmarshal(b, &file) != nil {
+		return
+	}
+	for _, ln := range file.Lines {
+		if _, ok := ln["Name"]; ok {
+			return
+		}
+	}
+	gr.NameLines()
+}
+
 // SaveJSON saves a graph to a JSON file
 func (gr *Graph) SaveJSON(filename core.Filename) error { //types:add
 	var err error
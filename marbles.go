@@ -9,6 +9,7 @@ import (
 	"cogentcore.org/core/base/errors"
 	"cogentcore.org/core/colors"
 	"cogentcore.org/core/math32"
+	"gonum.org/v1/gonum/spatial/r2"
 )
 
 // Marble contains the information of a marble
@@ -18,6 +19,26 @@ type Marble struct {
 	PrevPos      math32.Vector2
 	Color        color.RGBA
 	TrackingInfo TrackingInfo
+
+	// State is the evaluation state of the marble, with its own random stream,
+	// which the expressions use when they are evaluated for it
+	State *EvalState
+
+	// Index is the index of the marble, which is n in expressions
+	Index int
+
+	// Start is the time that the marble started at, which its age is from
+	Start float64
+
+	// Bounces is the number of times the marble has hit a line
+	Bounces int
+
+	// Hits are the numbers of times the marble has hit each line, by the index of the line.
+	// It is replaced instead of changed, so that environments can share it.
+	Hits []int
+
+	// ColorIndex is 0 if the marble has its own color, or k if it has the color switch of the k-th line
+	ColorIndex int
 }
 
 // TrackingInfo contains all of the tracking info for a marble.
@@ -45,37 +66,76 @@ func (gr *Graph) GraphMarblesInit() {
 
 // Init makes a marble
 func (m *Marble) Init(n int) {
-	if TheGraph.Params.MarbleStartX.Compile() != nil {
-		return
-	}
-	TheGraph.Params.MarbleStartX.Params["n"] = n
-	xPos := TheGraph.Params.MarbleStartX.Eval(0, 0, 0)
-
-	if TheGraph.Params.MarbleStartY.Compile() != nil {
+	m.State = NewEvalState(NewRand(uint64(n)))
+	m.State.MaxIntegrals = marbleIntegralCache
+	m.Index = n
+	m.Start = TheGraph.State.Time
+	pos, ok := StartPos(&Env{N: float64(n), State: m.State})
+	if !ok {
 		return
 	}
-	TheGraph.Params.MarbleStartY.Params["n"] = n
-	yPos := TheGraph.Params.MarbleStartY.Eval(xPos, 0, 0)
-
-	m.Pos = math32.Vector2{X: float32(xPos), Y: float32(yPos)}
+	m.Pos = math32.Vector2{X: float32(pos.X), Y: float32(pos.Y)}
 	// fmt.Printf("mb.Pos: %v \n", mb.Pos)
-	startY := TheGraph.Params.StartVelocityY.Eval(float64(m.Pos.X), float64(m.Pos.Y))
-	startX := TheGraph.Params.StartVelocityX.Eval(float64(m.Pos.X), float64(m.Pos.Y))
+	env := m.Env(0)
+	startY := TheGraph.Params.StartVelocityY.Eval(env)
+	startX := TheGraph.Params.StartVelocityX.Eval(env)
 	m.Velocity = math32.Vector2{X: float32(startX), Y: float32(startY)}
 	m.PrevPos = m.Pos
 	tls := TheGraph.Params.TrackingSettings
 	m.TrackingInfo.Track = tls.TrackByDefault
 }
 
+// StartPos returns the start position of a marble, and whether it could be evaluated, in the given
+// environment, which has the index of the marble. It uses MarbleStart if it is set, and MarbleStartX
+// and MarbleStartY otherwise, which are compiled by [Params.CompileStart].
+func StartPos(env *Env) (r2.Vec, bool) {
+	pr := &TheGraph.Params
+	if pr.MarbleStart.Expr != "" {
+		if pr.MarbleStart.Val == nil {
+			return r2.Vec{}, false
+		}
+		return pr.MarbleStart.EvalPoint(env), true
+	}
+	if pr.MarbleStartX.Val == nil || pr.MarbleStartY.Val == nil {
+		return r2.Vec{}, false
+	}
+	xPos := pr.MarbleStartX.EvalEnv(env)
+	e := *env
+	e.X = xPos
+	yPos := pr.MarbleStartY.EvalEnv(&e)
+	return r2.Vec{X: xPos, Y: yPos}, true
+}
+
+// Env returns the environment for evaluating expressions for the marble at the given time,
+// which has its position, velocity and the other [MarbleVars]
+func (m *Marble) Env(t float64) *Env {
+	return &Env{
+		X: float64(m.Pos.X), Y: float64(m.Pos.Y), T: t, N: float64(m.Index),
+		VX: float64(m.Velocity.X), VY: float64(m.Velocity.Y), Age: t - m.Start,
+		Bounces: float64(m.Bounces), Color: float64(m.ColorIndex), Hits: m.Hits, State: m.State,
+	}
+}
+
+// MarbleEnv returns the environment for evaluating the GraphIf and Bounce of the line at the given
+// point for a marble, from the environment of the marble
+func (ln *Line) MarbleEnv(menv *Env, x, y float64) *Env {
+	e := *menv
+	e.X, e.Y, e.H = x, y, float64(ln.TimesHit.Load())
+	return &e
+}
+
 // InitMarbles creates the marbles and puts them at their initial positions
 func (gr *Graph) InitMarbles() {
+	gr.State.Crowd.Store(nil)
 	gr.Marbles = make([]*Marble, 0)
 	for n := 0; n < gr.Params.NMarbles; n++ {
 		m := Marble{}
 		m.Init(n)
 		gr.Marbles = append(gr.Marbles, &m)
 	}
+	gr.State.Eval = NewEvalState(NewRand(RunStream))
 	gr.State.SelectedMarble = -1
+	gr.UpdateCrowd()
 }
 
 // ResetMarbles just calls InitMarbles and GraphMarblesInit
@@ -109,52 +169,94 @@ func (m *Marble) UpdateTracking() {
 	}
 }
 
-// UpdateMarblesData updates marbles data
+// Force returns the force on a marble in the given environment, which has its position.
+// It uses the Force param if it is set, and XForce and YForce otherwise.
+func (gr *Graph) Force(env *Env) r2.Vec {
+	if gr.Params.Force.Expr.Expr != "" {
+		return gr.Params.Force.EvalVec(env)
+	}
+	return r2.Vec{X: gr.Params.XForce.Eval(env), Y: gr.Params.YForce.Eval(env)}
+}
+
+// UpdateMarblesData updates marbles data. The marbles are evaluated while the graph is drawn,
+// and only the changes to them are done while holding [Graph.StateMu]. The expressions see the other marbles
+// through [Graph.Crowd] as they were at the start of the step, so the order that the marbles are updated in does not matter.
 func (gr *Graph) UpdateMarblesData() {
-	gr.EvalMu.Lock()
-	defer gr.EvalMu.Unlock()
+	gr.EvalMu.RLock()
+	defer gr.EvalMu.RUnlock()
 
+	gr.StateMu.Lock()
+	vecs, t, pt := gr.Vectors, gr.State.Time, gr.State.PrevTime
+	gr.StateMu.Unlock()
 	for _, m := range gr.Marbles {
-
-		m.Velocity.Y += float32(gr.Params.YForce.Eval(float64(m.Pos.X), float64(m.Pos.Y))) * ((gr.Vectors.Size.Y * gr.Vectors.Size.X) / 400)
-		m.Velocity.X += float32(gr.Params.XForce.Eval(float64(m.Pos.X), float64(m.Pos.Y))) * ((gr.Vectors.Size.Y * gr.Vectors.Size.X) / 400)
-		updtrate := float32(gr.Params.UpdateRate.Eval(float64(m.Pos.X), float64(m.Pos.Y)))
-		npos := m.Pos.Add(m.Velocity.MulScalar(updtrate))
-		ppos := m.Pos
+		env := m.Env(t)
+		force := gr.Force(env)
+		vel := m.Velocity
+		vel.Y += float32(force.Y) * ((vecs.Size.Y * vecs.Size.X) / 400)
+		vel.X += float32(force.X) * ((vecs.Size.Y * vecs.Size.X) / 400)
+		updtrate := float32(gr.Params.UpdateRate.Eval(env))
+		npos := m.Pos.Add(vel.MulScalar(updtrate))
+		pos := m.Pos
 		setColor := colors.White
-		for _, ln := range gr.Lines {
+		bounces, colorIndex, hits := m.Bounces, m.ColorIndex, m.Hits
+		// the lines see the velocity after the force
+		menv := *env
+		menv.VX, menv.VY = float64(vel.X), float64(vel.Y)
+		for k, ln := range gr.Lines {
 			if ln.Expr.Val == nil {
 				continue
 			}
 
 			// previous line y (with old time)
-			yp := ln.Expr.Eval(float64(m.Pos.X), gr.State.PrevTime, ln.TimesHit)
+			yp := ln.Expr.EvalEnv(ln.Env(&Env{T: pt, State: m.State}, float64(m.Pos.X)))
 			// new line y with old time
-			yno := ln.Expr.Eval(float64(npos.X), gr.State.PrevTime, ln.TimesHit)
+			yno := ln.Expr.EvalEnv(ln.Env(&Env{T: pt, State: m.State}, float64(npos.X)))
 			// new line y
-			yn := ln.Expr.Eval(float64(npos.X), gr.State.Time, ln.TimesHit)
-
-			if m.Collided(ln, npos, yp, yn) {
-				ln.TimesHit++
+			yn := ln.Expr.EvalEnv(ln.Env(env, float64(npos.X)))
+
+			if m.Collided(ln, &vecs, &menv, npos, yp, yn) {
+				ln.TimesHit.Add(1)
+				ln.Hits.Add(t)
+				bounces++
+				hits = slices.Clone(hits)
+				if len(hits) <= k {
+					hits = append(hits, make([]int, k+1-len(hits))...)
+				}
+				hits[k]++
 				setColor = ln.Colors.ColorSwitch
-				m.Pos, m.Velocity = m.CalcCollide(ln, npos, yp, yn, yno)
+				if setColor != colors.White {
+					colorIndex = k + 1
+				}
+				pos, vel = m.CalcCollide(ln, &menv, vel, npos, yp, yn, yno)
 				break
 			}
 		}
 
-		m.PrevPos = ppos
-		m.Pos = m.Pos.Add(m.Velocity.MulScalar(float32(gr.Params.UpdateRate.Eval(float64(m.Pos.X), float64(m.Pos.Y)))))
+		renv := menv
+		renv.X, renv.Y, renv.VX, renv.VY = float64(pos.X), float64(pos.Y), float64(vel.X), float64(vel.Y)
+		pos = pos.Add(vel.MulScalar(float32(gr.Params.UpdateRate.Eval(&renv))))
+		gr.StateMu.Lock()
+		m.PrevPos = m.Pos
+		m.Pos, m.Velocity = pos, vel
+		m.Bounces, m.ColorIndex, m.Hits = bounces, colorIndex, hits
 		if setColor != colors.White {
 			m.Color = setColor
 		}
 		m.UpdateTracking()
+		gr.StateMu.Unlock()
 	}
+	gr.StateMu.Lock()
+	gr.UpdateCrowd()
+	gr.StateMu.Unlock()
 }
 
-// Collided returns true if the marble has collided with the line, and false if the marble has not.
-func (m *Marble) Collided(ln *Line, npos math32.Vector2, yp, yn float64) bool {
-	graphIf := ln.GraphIf.EvalBool(float64(npos.X), yn, TheGraph.State.Time, ln.TimesHit)
-	inBounds := TheGraph.InBounds(npos)
+// Collided returns true if the marble with the given environment has collided with the line, and false if the marble has not.
+func (m *Marble) Collided(ln *Line, vecs *Vectors, menv *Env, npos math32.Vector2, yp, yn float64) bool {
+	if math.IsNaN(yp) || math.IsNaN(yn) { // the line has a gap, like in a piecewise line
+		return false
+	}
+	graphIf := ln.GraphIf.EvalBoolEnv(ln.MarbleEnv(menv, float64(npos.X), yn))
+	inBounds := vecs.InBounds(npos)
 	collided := (float64(npos.Y) < yn && float64(m.Pos.Y) >= yp) || (float64(npos.Y) > yn && float64(m.Pos.Y) <= yp)
 	if collided && graphIf && inBounds {
 		return true
@@ -162,11 +264,12 @@ func (m *Marble) Collided(ln *Line, npos math32.Vector2, yp, yn float64) bool {
 	return false
 }
 
-// CalcCollide calculates the new position and velocity of a marble after a collision with the given
-// line, given the previous line y, new line y, and new line y with old time
-func (m *Marble) CalcCollide(ln *Line, npos math32.Vector2, yp, yn, yno float64) (math32.Vector2, math32.Vector2) {
+// CalcCollide calculates the new position and velocity of a marble with the given environment and velocity after
+// a collision with the given line, given the previous line y, new line y, and new line y with old time
+func (m *Marble) CalcCollide(ln *Line, menv *Env, vel, npos math32.Vector2, yp, yn, yno float64) (math32.Vector2, math32.Vector2) {
 	dly := yn - yp // change in the lines y
 	dx := npos.X - m.Pos.X
+	env := &Env{T: menv.T, State: m.State}
 
 	var yi, xi float32
 
@@ -182,68 +285,94 @@ func (m *Marble) CalcCollide(ln *Line, npos math32.Vector2, yp, yn, yno float64)
 		mm := dmy / dx
 
 		xi = (npos.X*(ml-mm) + npos.Y - float32(yn)) / (ml - mm)
-		yi = float32(ln.Expr.Eval(float64(xi), TheGraph.State.Time, ln.TimesHit))
+		yi = float32(ln.Expr.EvalEnv(ln.Env(env, float64(xi))))
 		//		fmt.Printf("xi: %v, yi: %v \n", xi, yi)
+		if math.IsNaN(float64(yi)) { // the intersection is in a gap of the line
+			xi = npos.X
+			yi = float32(yn)
+		}
+	}
+	if math.IsNaN(yno) {
+		yno = yn
 	}
 
-	yl := ln.Expr.Eval(float64(xi)-.01, TheGraph.State.Time, ln.TimesHit) // point to the left of x
-	yr := ln.Expr.Eval(float64(xi)+.01, TheGraph.State.Time, ln.TimesHit) // point to the right of x
-
-	//slp := (yr - yl) / .02
-	angLn := math32.Atan2(float32(yr-yl), 0.02)
+	slp := ln.EvalDeriv(1, ln.Env(env, float64(xi)))
+	angLn := float32(math.Atan(slp))
 	angN := angLn + math.Pi/2 // + 90 deg
 
-	angI := math32.Atan2(m.Velocity.Y, m.Velocity.X)
+	angI := math32.Atan2(vel.Y, vel.X)
 	angII := angI + math.Pi
 
 	angNII := angN - angII
 	angR := math.Pi + 2*angNII
 
-	Bounce := ln.Bounce.EvalWithY(float64(npos.X), TheGraph.State.Time, ln.TimesHit, float64(yi))
+	Bounce := ln.Bounce.EvalEnv(ln.MarbleEnv(menv, float64(npos.X), float64(yi)))
 
-	nvx := float32(Bounce) * (m.Velocity.X*math32.Cos(angR) - m.Velocity.Y*math32.Sin(angR))
-	nvy := float32(Bounce) * (m.Velocity.X*math32.Sin(angR) + m.Velocity.Y*math32.Cos(angR))
+	nvx := float32(Bounce) * (vel.X*math32.Cos(angR) - vel.Y*math32.Sin(angR))
+	nvy := float32(Bounce) * (vel.X*math32.Sin(angR) + vel.Y*math32.Cos(angR))
 
-	vel := math32.Vector2{X: nvx, Y: nvy}
+	nvel := math32.Vector2{X: nvx, Y: nvy}
 	pos := math32.Vector2{X: xi, Y: yi + float32(yn-yno)} // adding change from prev time to current time in same pos fixes collisions with moving lines
 
-	return pos, vel
+	return pos, nvel
 }
 
 // InBounds checks whether a point is in the bounds of the graph
 func (gr *Graph) InBounds(pos math32.Vector2) bool {
-	if pos.Y > gr.Vectors.Min.Y && pos.Y < gr.Vectors.Max.Y && pos.X > gr.Vectors.Min.X && pos.X < gr.Vectors.Max.X {
+	return gr.Vectors.InBounds(pos)
+}
+
+// InBounds checks whether a point is in the given bounds of the graph
+func (v *Vectors) InBounds(pos math32.Vector2) bool {
+	if pos.Y > v.Min.Y && pos.Y < v.Max.Y && pos.X > v.Min.X && pos.X < v.Max.X {
 		return true
 	}
 	return false
 }
 
+// AdvanceTime moves the time forward by one time step
+func (gr *Graph) AdvanceTime() {
+	gr.EvalMu.RLock()
+	step := gr.Params.TimeStep.Eval(&Env{T: gr.State.Time, State: gr.State.Eval})
+	gr.EvalMu.RUnlock()
+	gr.StateMu.Lock()
+	gr.State.PrevTime = gr.State.Time
+	gr.State.Time += step
+	gr.StateMu.Unlock()
+}
+
 // RunMarbles runs the marbles for NSteps
 func (gr *Graph) RunMarbles() {
-	if gr.State.Running {
+	if !gr.State.Running.CompareAndSwap(false, true) {
 		return
 	}
-	gr.State.Running = true
 	gr.State.Step = 0
 	startFrames := 0
 	start := time.Now()
 	ticker := time.NewTicker(time.Second / 60)
 	for range ticker.C {
-		if !gr.State.Running {
+		if !gr.State.Running.Load() {
 			ticker.Stop()
+			if gr.Err() != nil {
+				gr.Objects.Graph.AsyncLock()
+				gr.UpdateDiagnostics()
+				gr.Objects.Graph.AsyncUnlock()
+			}
 			return
 		}
 		gr.State.Step++
-		if gr.State.Error != nil {
-			gr.State.Running = false
+		if gr.Err() != nil {
+			gr.Stop()
 		}
 		for j := 0; j < TheSettings.NFramesPer-1; j++ {
 			gr.UpdateMarblesData()
-			gr.State.PrevTime = gr.State.Time
-			gr.State.Time += gr.Params.TimeStep.Eval(0, 0)
+			gr.AdvanceTime()
 		}
 		gr.Objects.Graph.AsyncLock()
 		ok := gr.UpdateMarbles()
+		if gr.State.NewDiags.Load() {
+			gr.UpdateDiagnostics()
+		}
 		gr.Objects.Graph.AsyncUnlock()
 		if ok {
 			gr.State.Step--
@@ -255,8 +384,7 @@ func (gr *Graph) RunMarbles() {
 			start = time.Now()
 			startFrames = gr.State.Step
 		}
-		gr.State.PrevTime = gr.State.Time
-		gr.State.Time += gr.Params.TimeStep.Eval(0, 0)
+		gr.AdvanceTime()
 	}
 }
 
@@ -270,7 +398,7 @@ func (m *Marble) ToggleTrack(idx int) {
 
 // SelectNextMarble selects the next marble in the viewbox
 func (gr *Graph) SelectNextMarble() { //types:add
-	if !gr.State.Running {
+	if !gr.State.Running.Load() {
 		defer gr.Objects.Graph.NeedsRender()
 	}
 	gr.State.SelectedMarble++
@@ -0,0 +1,110 @@
+package main
+
+import "math"
+
+// Sign returns -1, 0 or 1 depending on the sign of x
+func Sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return x // 0 or NaN
+}
+
+// Clamp returns x limited to be between lo and hi
+func Clamp(x, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, x))
+}
+
+// Lerp returns the linear interpolation from a to b, which is a at t = 0 and b at t = 1
+func Lerp(a, b, t float64) float64 {
+	return a + t*(b-a)
+}
+
+// Smoothstep returns 0 for x below e0, 1 for x above e1, and a smooth curve between them
+func Smoothstep(e0, e1, x float64) float64 {
+	t := Clamp((x-e0)/(e1-e0), 0, 1)
+	return t * t * (3 - 2*t)
+}
+
+// Step returns 0 for x below edge and 1 otherwise
+func Step(edge, x float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(edge) {
+		return math.NaN()
+	}
+	if x < edge {
+		return 0
+	}
+	return 1
+}
+
+// Frac returns the fractional part of x, which is between 0 and 1 for negative numbers too
+func Frac(x float64) float64 {
+	return x - math.Floor(x)
+}
+
+// GCD returns the greatest common divisor of a and b, or NaN if they are not whole numbers
+func GCD(a, b float64) float64 {
+	if a != math.Trunc(a) || b != math.Trunc(b) {
+		return math.NaN()
+	}
+	a, b = math.Abs(a), math.Abs(b)
+	for b != 0 {
+		a, b = b, math.Mod(a, b)
+	}
+	return a
+}
+
+// LCM returns the least common multiple of a and b, or NaN if they are not whole numbers
+func LCM(a, b float64) float64 {
+	g := GCD(a, b)
+	if g == 0 {
+		return 0
+	}
+	return math.Abs(a / g * b)
+}
+
+// Lgamma returns the natural logarithm of the absolute value of the gamma function of x
+func Lgamma(x float64) float64 {
+	v, _ := math.Lgamma(x)
+	return v
+}
+
+// Beta returns the beta function of a and b, which is Γ(a)Γ(b)/Γ(a+b)
+func Beta(a, b float64) float64 {
+	la, sa := math.Lgamma(a)
+	lb, sb := math.Lgamma(b)
+	lab, sab := math.Lgamma(a + b)
+	return float64(sa*sb*sab) * math.Exp(la+lb-lab)
+}
+
+// Sinc returns sin(x)/x, which is 1 at x = 0
+func Sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(x) / x
+}
+
+// Tri returns a triangle wave with the same period, phase and amplitude as sin
+func Tri(x float64) float64 {
+	return 2 / math.Pi * math.Asin(math.Sin(x))
+}
+
+// Square returns a square wave with the same period and phase as sin, which is 1 where sin is positive and -1 elsewhere
+func Square(x float64) float64 {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return math.NaN()
+	}
+	if Frac(x/(2*math.Pi)) < 0.5 {
+		return 1
+	}
+	return -1
+}
+
+// Saw returns a sawtooth wave with the same period as sin, which goes up from -1 to 1 and is 0 at x = 0
+func Saw(x float64) float64 {
+	return 2*Frac(x/(2*math.Pi)+0.5) - 1
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// MaxOctaves is the largest number of octaves that fbm adds together
+const MaxOctaves = 16
+
+// noiseTable is the permutation table of the noise functions for a seed
+type noiseTable struct {
+	seed int64
+	perm [512]uint8
+}
+
+// theNoiseTable is the noise table for the last seed that was used
+var theNoiseTable atomic.Pointer[noiseTable]
+
+// noisePerm returns the permutation table of the noise functions for the seed of the graph
+func noisePerm() *[512]uint8 {
+	seed := TheGraph.Params.Seed
+	if t := theNoiseTable.Load(); t != nil && t.seed == seed {
+		return &t.perm
+	}
+	t := &noiseTable{seed: seed}
+	r := rand.New(rand.NewPCG(uint64(seed), NoiseStream))
+	p := r.Perm(256)
+	for i := range t.perm {
+		t.perm[i] = uint8(p[i%256])
+	}
+	theNoiseTable.Store(t)
+	return &t.perm
+}
+
+// fade is the curve 6t^5-15t^4+10t^3 that noise is interpolated with,
+// which has a continuous first and second derivative
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+// dfade is the derivative of [fade]
+func dfade(t float64) float64 {
+	return 30 * t * t * (t*(t-2) + 1)
+}
+
+// grad1 returns the gradient of 1D noise for the given hash, which is between -1 and 1
+func grad1(h uint8) float64 {
+	return float64(h)/127.5 - 1
+}
+
+// grad2 returns the gradient of 2D noise for the given hash, which is one of 8 unit vectors
+func grad2(h uint8) (float64, float64) {
+	const s = math.Sqrt2 / 2
+	switch h & 7 {
+	case 0:
+		return 1, 0
+	case 1:
+		return -1, 0
+	case 2:
+		return 0, 1
+	case 3:
+		return 0, -1
+	case 4:
+		return s, s
+	case 5:
+		return -s, s
+	case 6:
+		return s, -s
+	}
+	return -s, -s
+}
+
+// Perlin1 returns 1D Perlin noise at x, which is between -1 and 1, and its derivative
+func Perlin1(x float64) (float64, float64) {
+	p := noisePerm()
+	fl := math.Floor(x)
+	i, f := int(int64(fl)&255), x-fl
+	g0, g1 := grad1(p[i]), grad1(p[i+1])
+	a, b := g0*f, g1*(f-1)
+	u := fade(f)
+	return 2 * (a + u*(b-a)), 2 * (g0 + dfade(f)*(b-a) + u*(g1-g0))
+}
+
+// Perlin2 returns 2D Perlin noise at (x, y), which is between -1 and 1, and its partial derivatives
+func Perlin2(x, y float64) (float64, float64, float64) {
+	p := noisePerm()
+	flx, fly := math.Floor(x), math.Floor(y)
+	i, j := int(int64(flx)&255), int(int64(fly)&255)
+	fx, fy := x-flx, y-fly
+	// the value and partial derivatives of the gradient of the corner at (i+a, j+b)
+	corner := func(a, b int) (float64, float64, float64) {
+		gx, gy := grad2(p[int(p[i+a])+j+b])
+		return gx*(fx-float64(a)) + gy*(fy-float64(b)), gx, gy
+	}
+	n00, x00, y00 := corner(0, 0)
+	n10, x10, y10 := corner(1, 0)
+	n01, x01, y01 := corner(0, 1)
+	n11, x11, y11 := corner(1, 1)
+	u, v := fade(fx), fade(fy)
+	du, dv := dfade(fx), dfade(fy)
+
+	n0 := n00 + u*(n10-n00)
+	n1 := n01 + u*(n11-n01)
+	dx0 := x00 + du*(n10-n00) + u*(x10-x00)
+	dx1 := x01 + du*(n11-n01) + u*(x11-x01)
+	dy0 := y00 + u*(y10-y00)
+	dy1 := y01 + u*(y11-y01)
+
+	n := n0 + v*(n1-n0)
+	dx := dx0 + v*(dx1-dx0)
+	dy := dy0 + dv*(n1-n0) + v*(dy1-dy0)
+	return math.Sqrt2 * n, math.Sqrt2 * dx, math.Sqrt2 * dy
+}
+
+// Simplex2 returns 2D simplex noise at (x, y), which is between about -1 and 1, and its partial derivatives
+func Simplex2(x, y float64) (float64, float64, float64) {
+	const (
+		f2 = 0.36602540378443865 // (√3-1)/2
+		g2 = 0.21132486540518713 // (3-√3)/6
+	)
+	p := noisePerm()
+	s := (x + y) * f2
+	fi, fj := math.Floor(x+s), math.Floor(y+s)
+	t := (fi + fj) * g2
+	x0, y0 := x-(fi-t), y-(fj-t)
+	var i1, j1 int
+	if x0 > y0 {
+		i1 = 1
+	} else {
+		j1 = 1
+	}
+	i, j := int(int64(fi)&255), int(int64(fj)&255)
+	var n, dx, dy float64
+	for k, c := range [3][2]int{{0, 0}, {i1, j1}, {1, 1}} {
+		cx := x0 - float64(c[0]) + float64(k)*g2
+		cy := y0 - float64(c[1]) + float64(k)*g2
+		t := 0.5 - cx*cx - cy*cy
+		if t <= 0 {
+			continue
+		}
+		gx, gy := grad2(p[int(p[i+c[0]])+j+c[1]])
+		gd := gx*cx + gy*cy
+		t2 := t * t
+		t4 := t2 * t2
+		n += t4 * gd
+		dx += t4*gx - 8*t2*t*cx*gd
+		dy += t4*gy - 8*t2*t*cy*gd
+	}
+	return 70 * n, 70 * dx, 70 * dy
+}
+
+// FBM returns fractal Brownian motion at x, which is 1D Perlin noise with the given number of octaves
+// that each have twice the frequency and persistence times the amplitude of the last one, and its derivative.
+// It is normalized to be between -1 and 1.
+func FBM(x, octaves, persistence float64) (float64, float64) {
+	oct := int(math.Round(octaves))
+	if oct < 1 || oct > MaxOctaves || math.IsNaN(persistence) {
+		return math.NaN(), math.NaN()
+	}
+	var n, dn, total float64
+	amp, freq := 1.0, 1.0
+	for range oct {
+		v, d := Perlin1(freq * x)
+		n += amp * v
+		dn += amp * freq * d
+		total += math.Abs(amp)
+		amp *= persistence
+		freq *= 2
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return n / total, dn / total
+}
+
+// Perlin is the perlin function: perlin(x) is 1D Perlin noise and perlin(x, t) is 2D Perlin noise,
+// which can be used to make a line wobble over time
+func Perlin(env *Env, args []float64) float64 {
+	switch len(args) {
+	case 1:
+		v, _ := Perlin1(args[0])
+		return v
+	case 2:
+		v, _, _ := Perlin2(args[0], args[1])
+		return v
+	}
+	return math.NaN()
+}
+
+// PerlinDeriv is the derivative of [Perlin] with respect to x
+func PerlinDeriv(env *Env, args []float64) float64 {
+	switch len(args) {
+	case 1:
+		_, d := Perlin1(args[0])
+		return d
+	case 2:
+		_, d, _ := Perlin2(args[0], args[1])
+		return d
+	}
+	return math.NaN()
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TokenKind is the kind of a lexical token in an expression
+type TokenKind int
+
+const (
+	// TokenEOF marks the end of the expression
+	TokenEOF TokenKind = iota
+
+	// TokenNumber is a number literal, like 2 or .05
+	TokenNumber
+
+	// TokenName is a variable or function name
+	TokenName
+
+	// TokenOp is an operator, like + or &&
+	TokenOp
+
+	// TokenLParen is an opening parenthesis
+	TokenLParen
+
+	// TokenRParen is a closing parenthesis
+	TokenRParen
+
+	// TokenComma separates function arguments and the cases of a piecewise expression
+	TokenComma
+
+	// TokenLBrace starts a piecewise expression
+	TokenLBrace
+
+	// TokenRBrace ends a piecewise expression
+	TokenRBrace
+
+	// TokenColon separates the condition and value of a case of a piecewise expression
+	TokenColon
+
+	// TokenDot is the . before the x or y component of a point, like p.x
+	TokenDot
+)
+
+// Token is one lexical token of an expression
+type Token struct {
+	Kind TokenKind
+
+	// Text is the normalized text of the token (for example, sqrt for √)
+	Text string
+
+	// Pos and End are the rune offsets of the token in the source expression
+	Pos, End int
+}
+
+// NameKind is the kind of thing a name refers to in an expression
+type NameKind int
+
+const (
+	// NameUnknown is a name that does not refer to anything
+	NameUnknown NameKind = iota
+
+	// NameVariable is a name that refers to a value, like x or π
+	NameVariable
+
+	// NameFunction is a name that refers to a function that takes arguments
+	NameFunction
+
+	// NameZeroArg is a name that refers to a function that takes no arguments
+	NameZeroArg
+)
+
+// MarbleVars are the variables about a marble, which have its values in the params and
+// the GraphIf and Bounce of lines when they are evaluated for a marble, and are 0 otherwise
+var MarbleVars = []string{"n", "vx", "vy", "speed", "age", "bounces", "color"}
+
+// ExprParams are the variables that can be used in every expression, including the imaginary unit i
+var ExprParams = append([]string{"π", "e", "i", "x", "a", "t", "h", "y"}, MarbleVars...)
+
+// SpecialForms are the functions that are compiled specially instead of being in [Functions]:
+// if only evaluates the value it chooses, d and int take an expression and a variable,
+// sum and prod bind an index variable, and dot, len, normalize and rotate take points.
+var SpecialForms = []string{"if", "d", "int", "sum", "prod", "dot", "len", "normalize", "rotate"}
+
+// Binders are the special forms whose first argument is the name of a new index variable,
+// like i in sum(i, 1, 10, i^2)
+var Binders = []string{"sum", "prod"}
+
+// IsBuiltinName returns whether the name is one of the [ExprParams], true or false, or one of the [SpecialForms]
+func IsBuiltinName(name string) bool {
+	return slices.Contains(ExprParams, name) || name == "true" || name == "false" || slices.Contains(SpecialForms, name)
+}
+
+// NameAliases are alternative spellings of names that are replaced before lookup
+var NameAliases = map[string]string{
+	"pi": "π",
+
+	// ∏ stands for psum so that fpsum keeps working
+	"psum": "prod",
+}
+
+// Scope looks up what a name refers to while parsing an expression
+type Scope func(name string) NameKind
+
+// Context contains the functions and variables that names can refer to in expressions
+type Context struct {
+	Functions Functions
+
+	Variables Variables
+
+	// Lines are the lines that functions like hits(f) refer to
+	Lines Lines
+
+	// Locals are the names of the parameters of the helper function being compiled,
+	// which are in the Args of the [Env] and take precedence over all other names
+	Locals []string
+
+	// Warn reports a problem found while evaluating that does not stop evaluation,
+	// like root not finding a root. It can be nil.
+	Warn func(err error)
+}
+
+// Scope returns a scope containing the locals, the [ExprParams], true and false, if, and the functions and variables of the context
+func (cx *Context) Scope() Scope {
+	return func(name string) NameKind {
+		for _, l := range cx.Locals {
+			if name == l {
+				return NameVariable
+			}
+		}
+		if name == "true" || name == "false" {
+			return NameVariable
+		}
+		if slices.Contains(SpecialForms, name) {
+			return NameFunction
+		}
+		for _, p := range ExprParams {
+			if name == p {
+				return NameVariable
+			}
+		}
+		if cx.Variables.Find(name) != nil {
+			return NameVariable
+		}
+		if fn, ok := cx.Functions[name]; ok {
+			if fn.NArgs == 0 {
+				return NameZeroArg
+			}
+			return NameFunction
+		}
+		return NameUnknown
+	}
+}
+
+// SyntaxError is an error in the syntax of an expression, with the rune offsets of the problem
+type SyntaxError struct {
+	Pos, End int
+	Msg      string
+}
+
+func (se *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", se.Pos+1, se.Msg)
+}
+
+// Lex splits an expression into tokens. Runs of letters are split into the
+// longest names known to the scope, so sinx is sin x, ax is a x, and exp is exp.
+// Letters that are not part of a known name are a name token of their own, which the parser reports.
+func Lex(expr string, scope Scope) ([]Token, error) {
+	return lexFrom([]rune(expr), 0, scope)
+}
+
+// lexFrom splits the source into tokens, starting at the given rune
+func lexFrom(src []rune, start int, scope Scope) ([]Token, error) {
+	toks := []Token{}
+	for i := start; i < len(src); {
+		r := src[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(src) && unicode.IsDigit(src[i+1])):
+			start := i
+			seenDot := false
+			for i < len(src) && (unicode.IsDigit(src[i]) || (src[i] == '.' && !seenDot)) {
+				if src[i] == '.' {
+					seenDot = true
+				}
+				i++
+			}
+			toks = append(toks, Token{Kind: TokenNumber, Text: string(src[start:i]), Pos: start, End: i})
+		case isNameRune(r):
+			start := i
+			for i < len(src) && (isNameRune(src[i]) || unicode.IsDigit(src[i]) || src[i] == '\'' || src[i] == '"') {
+				i++
+			}
+			names, n := splitNames(src[start:i], start, scope)
+			toks = append(toks, names...)
+			i = start + n
+		case r == '(':
+			toks = append(toks, Token{Kind: TokenLParen, Text: "(", Pos: i, End: i + 1})
+			i++
+		case r == ')':
+			toks = append(toks, Token{Kind: TokenRParen, Text: ")", Pos: i, End: i + 1})
+			i++
+		case r == ',':
+			toks = append(toks, Token{Kind: TokenComma, Text: ",", Pos: i, End: i + 1})
+			i++
+		case r == '{':
+			toks = append(toks, Token{Kind: TokenLBrace, Text: "{", Pos: i, End: i + 1})
+			i++
+		case r == '}':
+			toks = append(toks, Token{Kind: TokenRBrace, Text: "}", Pos: i, End: i + 1})
+			i++
+		case r == ':':
+			toks = append(toks, Token{Kind: TokenColon, Text: ":", Pos: i, End: i + 1})
+			i++
+		case r == '.':
+			toks = append(toks, Token{Kind: TokenDot, Text: ".", Pos: i, End: i + 1})
+			i++
+		default:
+			op := lexOp(src[i:])
+			if op == "" {
+				return nil, &SyntaxError{i, i + 1, fmt.Sprintf("unexpected character %q", r)}
+			}
+			n := len([]rune(op))
+			if op == "**" {
+				op = "^"
+			} else if op == "=" {
+				op = "=="
+			}
+			toks = append(toks, Token{Kind: TokenOp, Text: op, Pos: i, End: i + n})
+			i += n
+		}
+	}
+	toks = append(toks, Token{Kind: TokenEOF, Pos: len(src), End: len(src)})
+	return toks, nil
+}
+
+// isNameRune returns whether the given rune can be part of a name
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicodeName(r) != ""
+}
+
+// unicodeName returns the name that a unicode symbol like √ or Σ stands for, using [UnreadableChangeSlice]
+func unicodeName(r rune) string {
+	for _, d := range UnreadableChangeSlice {
+		if d.Old == string(r) {
+			return d.New
+		}
+	}
+	return ""
+}
+
+// lexOp returns the operator at the start of the given runes, or "" if there is none
+func lexOp(src []rune) string {
+	for _, op := range []string{"**", "&&", "||", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "^", "<", ">", "=", "!"} {
+		if strings.HasPrefix(string(src), op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// splitNames splits a run of name runes and digits into the longest names known to the scope,
+// and returns the tokens and the number of runes of the run that they use. Digits can be
+// part of names like floor2, and otherwise end the names so that they are lexed as a number.
+// Primes are part of names, and two single quotes are the same as a double quote.
+// Letters that do not start a known name are a token up to the end of the letters.
+func splitNames(run []rune, offset int, scope Scope) ([]Token, int) {
+	// norm is the normalized text, and pos maps each normalized rune to its source rune
+	norm := []rune{}
+	pos := []int{}
+	for i := 0; i < len(run); i++ {
+		r := run[i]
+		if r == '\'' && i+1 < len(run) && run[i+1] == '\'' {
+			norm = append(norm, '"')
+			pos = append(pos, offset+i)
+			i++
+			continue
+		}
+		if un := unicodeName(r); un != "" {
+			for _, ur := range un {
+				norm = append(norm, ur)
+				pos = append(pos, offset+i)
+			}
+			continue
+		}
+		norm = append(norm, r)
+		pos = append(pos, offset+i)
+	}
+	srcEnd := func(j int) int {
+		if j >= len(pos) {
+			return offset + len(run)
+		}
+		return pos[j]
+	}
+
+	toks := []Token{}
+	for i := 0; i < len(norm); {
+		best := ""
+		bestLen := 0
+		for j := len(norm); j > i; j-- {
+			name := lookupName(string(norm[i:j]), scope)
+			if name != "" {
+				best = name
+				bestLen = j - i
+				break
+			}
+		}
+		if bestLen == 0 {
+			if unicode.IsDigit(norm[i]) {
+				return toks, pos[i] - offset
+			}
+			end := i + 1
+			for end < len(norm) && unicode.IsLetter(norm[end]) {
+				end++
+			}
+			toks = append(toks, Token{Kind: TokenName, Text: string(norm[i:end]), Pos: pos[i], End: srcEnd(end)})
+			i = end
+			continue
+		}
+		toks = append(toks, Token{Kind: TokenName, Text: best, Pos: pos[i], End: srcEnd(i + bestLen)})
+		i += bestLen
+	}
+	return toks, len(run)
+}
+
+// lookupName returns the name that the given text refers to in the scope, or "" if
+// it does not refer to anything. Aliases and uppercase versions of variables are accepted.
+func lookupName(text string, scope Scope) string {
+	if alias, ok := NameAliases[text]; ok {
+		text = alias
+	}
+	if scope(text) != NameUnknown {
+		return text
+	}
+	lower := strings.ToLower(text)
+	if lower != text && scope(lower) == NameVariable {
+		return lower
+	}
+	return ""
+}
+
+// Parser parses the tokens of an expression into a syntax tree
+type Parser struct {
+	Toks  []Token
+	Scope Scope
+	pos   int
+
+	// src is the source of the expression, which is lexed again when the scope changes
+	src []rune
+}
+
+// ParseExpr parses an expression in the Marbles math dialect into a syntax tree.
+//
+// The grammar, from lowest to highest precedence, is:
+//
+//	or      = and {"||" and}
+//	and     = compare {"&&" compare}
+//	compare = sum [("==" | "!=" | "<" | "<=" | ">" | ">=") sum]
+//	sum     = product {("+" | "-") product}
+//	product = unary {("*" | "/" | "%") unary | power}
+//	unary   = ("-" | "+" | "!") unary | power
+//	power   = postfix ["^" unary]
+//	postfix = primary {"." ("x" | "y")}
+//	primary = number | variable | call | "(" or ")" | point | piecewise | function-reference
+//	point   = "(" or "," or ")"
+//	call    = function "(" [or {"," or}] ")" | function primary | zero-arg-function ["(" ")"]
+//	piecewise = "{" or ":" or {"," or ":" or} ["," or] "}"
+//
+// A power directly after another factor is multiplied with it, so 2x is 2*x and
+// (x+1)(x-1) is (x+1)*(x-1). A function that is not followed by parentheses is
+// applied to the next primary, so sinx^2 is sin(x)^2. A piecewise expression like
+// {x<0: x^2, x<3: 2x, 5} has the value of the first case whose condition is true,
+// or the last value without a condition if there is one. A function that is directly
+// followed by "," or ")" is a reference to that function, like f in root(f, 0, 1).
+// A point like (3, 4) has x and y components that are used with p.x and p.y.
+func ParseExpr(expr string, scope Scope) (Node, error) {
+	src := []rune(expr)
+	toks, err := lexFrom(src, 0, scope)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{Toks: toks, Scope: scope, src: src}
+	if p.peek().Kind == TokenEOF {
+		return nil, &SyntaxError{0, 0, "empty expression"}
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.Kind != TokenEOF {
+		return nil, p.errorf(t, "unexpected %q", t.Text)
+	}
+	return n, nil
+}
+
+// setScope changes the scope and lexes the tokens that have not been parsed yet again in it
+func (p *Parser) setScope(scope Scope) error {
+	p.Scope = scope
+	toks, err := lexFrom(p.src, p.peek().Pos, scope)
+	if err != nil {
+		return err
+	}
+	p.Toks = append(p.Toks[:p.pos], toks...)
+	return nil
+}
+
+func (p *Parser) peek() Token {
+	return p.Toks[p.pos]
+}
+
+func (p *Parser) next() Token {
+	t := p.Toks[p.pos]
+	if t.Kind != TokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *Parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.Kind != TokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.Text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Parser) errorf(t Token, format string, args ...any) error {
+	if t.Kind == TokenEOF {
+		return &SyntaxError{t.Pos, t.End, "unexpected end of expression"}
+	}
+	return &SyntaxError{t.Pos, t.End, fmt.Sprintf(format, args...)}
+}
+
+func (p *Parser) parseBinary(ops []string, operand func() (Node, error)) (Node, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.next().Text
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryNode{Op: op, X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parseOr() (Node, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *Parser) parseAnd() (Node, error) {
+	return p.parseBinary([]string{"&&"}, p.parseCompare)
+}
+
+func (p *Parser) parseCompare() (Node, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		op := p.next().Text
+		y, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryNode{Op: op, X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parseSum() (Node, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *Parser) parseProduct() (Node, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.isOp("*", "/", "%") {
+			op := p.next().Text
+			y, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			x = &BinaryNode{Op: op, X: x, Y: y}
+			continue
+		}
+		switch p.peek().Kind {
+		case TokenNumber, TokenName, TokenLParen, TokenLBrace:
+			y, err := p.parsePower()
+			if err != nil {
+				return nil, err
+			}
+			x = &BinaryNode{Op: "*", X: x, Y: y}
+			continue
+		}
+		return x, nil
+	}
+}
+
+func (p *Parser) parseUnary() (Node, error) {
+	if p.isOp("-", "+", "!") {
+		t := p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.Text == "+" {
+			return x, nil
+		}
+		return &UnaryNode{Op: t.Text, X: x, OpPos: t.Pos}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *Parser) parsePower() (Node, error) {
+	x, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("^") {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryNode{Op: "^", X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parsePrimary() (Node, error) {
+	t := p.next()
+	switch t.Kind {
+	case TokenNumber:
+		v, err := strconv.ParseFloat(t.Text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.Text)
+		}
+		return &NumberNode{Val: v, Text: t.Text, NodePos: t.Pos, NodeEnd: t.End}, nil
+	case TokenLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		var y Node
+		if p.peek().Kind == TokenComma {
+			p.next()
+			y, err = p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+		}
+		r := p.next()
+		if r.Kind != TokenRParen {
+			return nil, p.errorf(r, "expected ) but found %q", r.Text)
+		}
+		if y != nil {
+			return &PointNode{X: x, Y: y, NodePos: t.Pos, NodeEnd: r.End}, nil
+		}
+		return &ParenNode{X: x, NodePos: t.Pos, NodeEnd: r.End}, nil
+	case TokenLBrace:
+		return p.parsePiecewise(t)
+	case TokenName:
+		switch p.Scope(t.Text) {
+		case NameVariable:
+			if t.Text == "true" || t.Text == "false" {
+				return &BoolNode{Val: t.Text == "true", NodePos: t.Pos, NodeEnd: t.End}, nil
+			}
+			return &VarNode{Name: t.Text, NodePos: t.Pos, NodeEnd: t.End}, nil
+		case NameZeroArg:
+			c := &CallNode{Name: t.Text, NodePos: t.Pos, NodeEnd: t.End}
+			if p.peek().Kind == TokenLParen && p.Toks[p.pos+1].Kind == TokenRParen {
+				p.next()
+				c.NodeEnd = p.next().End
+				c.Paren = true
+			}
+			return c, nil
+		case NameFunction:
+			if k := p.peek().Kind; k == TokenComma || k == TokenRParen {
+				return &FuncNode{Name: t.Text, NodePos: t.Pos, NodeEnd: t.End}, nil
+			}
+			return p.parseCall(t)
+		}
+		return nil, p.errorf(t, "unknown name %q", t.Text)
+	}
+	return nil, p.errorf(t, "unexpected %q", t.Text)
+}
+
+// parsePostfix parses a primary followed by any number of point components, like p.x
+func (p *Parser) parsePostfix() (Node, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().Kind == TokenDot {
+		p.next()
+		f := p.next()
+		if f.Kind != TokenName || (f.Text != "x" && f.Text != "y") {
+			return nil, p.errorf(f, "expected x or y after . but found %q", f.Text)
+		}
+		x = &MemberNode{X: x, Field: f.Text, NodeEnd: f.End}
+	}
+	return x, nil
+}
+
+func (p *Parser) parsePiecewise(open Token) (Node, error) {
+	pw := &PiecewiseNode{NodePos: open.Pos}
+	for {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().Kind != TokenColon {
+			pw.Else = x
+			r := p.next()
+			if r.Kind != TokenRBrace {
+				return nil, p.errorf(r, "expected } after the value without a condition but found %q", r.Text)
+			}
+			pw.NodeEnd = r.End
+			return pw, nil
+		}
+		p.next()
+		v, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		pw.Conds = append(pw.Conds, x)
+		pw.Vals = append(pw.Vals, v)
+		switch t := p.next(); t.Kind {
+		case TokenComma:
+			continue
+		case TokenRBrace:
+			pw.NodeEnd = t.End
+			return pw, nil
+		default:
+			return nil, p.errorf(t, "expected , or } but found %q", t.Text)
+		}
+	}
+}
+
+func (p *Parser) parseCall(name Token) (Node, error) {
+	c := &CallNode{Name: name.Text, NodePos: name.Pos}
+	if p.peek().Kind != TokenLParen {
+		arg, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		c.Args = []Node{arg}
+		c.NodeEnd = arg.End()
+		return c, nil
+	}
+	p.next()
+	c.Paren = true
+	if p.peek().Kind == TokenRParen {
+		c.NodeEnd = p.next().End
+		return c, nil
+	}
+	if slices.Contains(Binders, c.Name) {
+		return p.parseBinder(c)
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+		t := p.next()
+		if t.Kind == TokenRParen {
+			c.NodeEnd = t.End
+			return c, nil
+		}
+		if t.Kind != TokenComma {
+			return nil, p.errorf(t, "expected , or ) but found %q", t.Text)
+		}
+	}
+}
+
+// parseBinder parses the arguments of a call to one of the [Binders] after its opening parenthesis,
+// like sum(i, 1, 10, i^2). The index is only a variable in the body, where it hides other names.
+func (p *Parser) parseBinder(c *CallNode) (Node, error) {
+	start := p.peek().Pos
+	end := start
+	for end < len(p.src) && (unicode.IsLetter(p.src[end]) || (end > start && unicode.IsDigit(p.src[end]))) {
+		end++
+	}
+	if end == start {
+		return nil, p.errorf(p.peek(), "the first argument of %v needs to be the name of its index, like i", c.Name)
+	}
+	index := string(p.src[start:end])
+	c.Args = append(c.Args, &VarNode{Name: index, NodePos: start, NodeEnd: end})
+	outer := p.Scope
+	toks, err := lexFrom(p.src, end, outer)
+	if err != nil {
+		return nil, err
+	}
+	p.Toks = append(p.Toks[:p.pos], toks...)
+	for i := range 3 {
+		if t := p.next(); t.Kind != TokenComma {
+			return nil, p.errorf(t, "%v needs an index, two bounds and a body, like %v(i, 1, 10, i^2)", c.Name, c.Name)
+		}
+		if i == 2 {
+			break
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+	}
+	err = p.setScope(func(name string) NameKind {
+		if name == index {
+			return NameVariable
+		}
+		return outer(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	c.Args = append(c.Args, body)
+	if err := p.setScope(outer); err != nil {
+		return nil, err
+	}
+	for {
+		t := p.next()
+		if t.Kind == TokenRParen {
+			c.NodeEnd = t.End
+			return c, nil
+		}
+		if t.Kind != TokenComma {
+			return nil, p.errorf(t, "expected , or ) but found %q", t.Text)
+		}
+		arg, err := p.parseOr() // extra arguments are reported when compiling
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+	}
+}
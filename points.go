@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/spatial/r2"
+)
+
+// pointConst returns a compiled constant point
+func pointConst(v r2.Vec) *Compiled {
+	return &Compiled{Kind: KindPoint, Pt: func(env *Env) r2.Vec { return v }, Const: true}
+}
+
+// compilePoint compiles a point like (3, 4) from its components
+func compilePoint(n *PointNode, cx *Context) (*Compiled, error) {
+	x, err := CompileNode(n.X, cx)
+	if err != nil {
+		return nil, err
+	}
+	y, err := CompileNode(n.Y, cx)
+	if err != nil {
+		return nil, err
+	}
+	if x.Kind != KindNumber || y.Kind != KindNumber {
+		return nil, compileError(n, "the components of a point need to be float64 values, not %v and %v values", x.Kind, y.Kind)
+	}
+	xf, yf := x.Num, y.Num
+	return &Compiled{Kind: KindPoint, Const: x.Const && y.Const, Pt: func(env *Env) r2.Vec {
+		return r2.Vec{X: xf(env), Y: yf(env)}
+	}}, nil
+}
+
+// compileMember compiles the x or y component of a point, like p.x
+func compileMember(n *MemberNode, cx *Context) (*Compiled, error) {
+	p, err := CompileNode(n.X, cx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Kind != KindPoint {
+		return nil, compileError(n, "can only get .%v of a point, not a %v value", n.Field, p.Kind)
+	}
+	pf := p.Pt
+	res := &Compiled{Kind: KindNumber, Const: p.Const}
+	if n.Field == "x" {
+		res.Num = func(env *Env) float64 { return pf(env).X }
+	} else {
+		res.Num = func(env *Env) float64 { return pf(env).Y }
+	}
+	return res, nil
+}
+
+// compilePointBinary compiles a binary operation where at least one of the values is a point.
+// Points can be added to and subtracted from each other, and multiplied and divided by numbers.
+func compilePointBinary(n *BinaryNode, x, y *Compiled) (*Compiled, error) {
+	res := &Compiled{Kind: KindPoint, Const: x.Const && y.Const}
+	switch {
+	case x.Kind == KindPoint && y.Kind == KindPoint:
+		xf, yf := x.Pt, y.Pt
+		switch n.Op {
+		case "+":
+			res.Pt = func(env *Env) r2.Vec { return r2.Add(xf(env), yf(env)) }
+		case "-":
+			res.Pt = func(env *Env) r2.Vec { return r2.Sub(xf(env), yf(env)) }
+		case "==":
+			res.Kind = KindBool
+			res.Bool = func(env *Env) bool { return xf(env) == yf(env) }
+		case "!=":
+			res.Kind = KindBool
+			res.Bool = func(env *Env) bool { return xf(env) != yf(env) }
+		}
+	case x.Kind == KindPoint && y.Kind == KindNumber:
+		xf, yf := x.Pt, y.Num
+		switch n.Op {
+		case "*":
+			res.Pt = func(env *Env) r2.Vec { return r2.Scale(yf(env), xf(env)) }
+		case "/":
+			res.Pt = func(env *Env) r2.Vec { return r2.Scale(1/yf(env), xf(env)) }
+		}
+	case x.Kind == KindNumber && y.Kind == KindPoint:
+		xf, yf := x.Num, y.Pt
+		if n.Op == "*" {
+			res.Pt = func(env *Env) r2.Vec { return r2.Scale(xf(env), yf(env)) }
+		}
+	}
+	if res.Pt == nil && res.Bool == nil {
+		return nil, compileError(n, "operator %v can not be used with %v and %v values", n.Op, x.Kind, y.Kind)
+	}
+	return res, nil
+}
+
+// compilePointCall compiles a call to one of the [SpecialForms] that take points:
+// dot(p, q), len(p), normalize(p) and rotate(p, θ), which rotates p by θ radians around the origin
+func compilePointCall(n *CallNode, cx *Context) (*Compiled, error) {
+	kinds := map[string][]Kind{
+		"dot":       {KindPoint, KindPoint},
+		"len":       {KindPoint},
+		"normalize": {KindPoint},
+		"rotate":    {KindPoint, KindNumber},
+	}[n.Name]
+	if len(n.Args) != len(kinds) {
+		return nil, compileError(n, "function %v needs %v arguments, not %v arguments", n.Name, len(kinds), len(n.Args))
+	}
+	cs := make([]*Compiled, len(n.Args))
+	isConst := true
+	for i, a := range n.Args {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind != kinds[i] {
+			return nil, compileError(a, "argument %v of %v needs to be a %v value, not a %v value", i, n.Name, kinds[i], c.Kind)
+		}
+		cs[i] = c
+		isConst = isConst && c.Const
+	}
+	p := cs[0].Pt
+	switch n.Name {
+	case "dot":
+		q := cs[1].Pt
+		return &Compiled{Kind: KindNumber, Const: isConst, Num: func(env *Env) float64 { return r2.Dot(p(env), q(env)) }}, nil
+	case "len":
+		return &Compiled{Kind: KindNumber, Const: isConst, Num: func(env *Env) float64 { return r2.Norm(p(env)) }}, nil
+	case "normalize":
+		return &Compiled{Kind: KindPoint, Const: isConst, Pt: func(env *Env) r2.Vec { return r2.Unit(p(env)) }}, nil
+	}
+	theta := cs[1].Num
+	return &Compiled{Kind: KindPoint, Const: isConst, Pt: func(env *Env) r2.Vec {
+		return r2.Rotate(p(env), theta(env), r2.Vec{})
+	}}, nil
+}
+
+// pointDerivative returns the derivative of dot, len or rotate with respect to v,
+// or nil if it can not be differentiated symbolically
+func pointDerivative(n *CallNode, v string, cx *Context) Node {
+	if len(n.Args) == 0 {
+		return nil
+	}
+	p := n.Args[0]
+	dp := Derivative(p, v, cx)
+	switch {
+	case n.Name == "dot" && len(n.Args) == 2:
+		q := n.Args[1]
+		return add(call("dot", dp, q), call("dot", p, Derivative(q, v, cx)))
+	case n.Name == "len" && len(n.Args) == 1:
+		return div(call("dot", p, dp), call("len", p))
+	case n.Name == "rotate" && len(n.Args) == 2:
+		theta := n.Args[1]
+		return add(call("rotate", dp, theta), mul(call("rotate", p, add(theta, num(math.Pi/2))), Derivative(theta, v, cx)))
+	}
+	return nil
+}
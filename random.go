@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// The random streams that are not the stream of a marble, which is its index
+const (
+	// RunStream is the random stream used for everything in a run that is not about one marble
+	RunStream = math.MaxUint64 - iota
+
+	// DrawStream is the random stream used for drawing the graph, which starts
+	// over every time it is drawn so that the lines do not change between frames
+	DrawStream
+
+	// NoiseStream is the random stream used to make the permutation table of the noise functions
+	NoiseStream
+)
+
+// NewRand returns the random stream with the given index for the seed of the graph.
+// Each marble has its own stream, so that runs with the same seed give the same results.
+func NewRand(stream uint64) *rand.Rand {
+	return rand.New(rand.NewPCG(uint64(TheGraph.Params.Seed), stream))
+}
+
+// NewRandFunc makes a random function that can be used in expressions from a function
+// that takes the random stream of the evaluation and the arguments
+func NewRandFunc(nargs int, f func(r *rand.Rand, args []float64) float64) *Function {
+	return &Function{NArgs: nargs, Call: func(env *Env, args []float64) float64 {
+		return f(env.state().Rand, args)
+	}}
+}
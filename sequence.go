@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// memoGen is incremented whenever an expression or helper is compiled, which makes the memoized
+// terms of all sequences and the cached integrals of all lines outdated
+var memoGen int
+
+// seqMemo has the memoized terms of a sequence in an [EvalState], which are valid for the environment with key
+type seqMemo struct {
+	gen   int
+	key   [10]float64
+	usesX bool
+
+	// vals are the terms that have been evaluated
+	vals map[float64]float64
+
+	// busy are the indices of the terms that are being evaluated, in the order they started
+	busy []float64
+}
+
+// memoKey returns the parts of the environment that the terms of the sequence can depend on
+func (m *seqMemo) memoKey(env *Env) [10]float64 {
+	key := [10]float64{0, env.Y, env.T, env.H, env.N, env.VX, env.VY, env.Age, env.Bounces, env.Color}
+	if m.usesX {
+		key[0] = env.X
+	}
+	return key
+}
+
+// usesX returns whether the terms of the sequence depend on x, through the body and base cases
+// of the helper or anything that they use. Line functions use their argument as x instead.
+func (h *Helper) usesX() bool {
+	d := TheGraph.HelperDeps(h)
+	return d.Uses("x")
+}
+
+// Term returns the term of the sequence that the helper defines with the given index in the given environment,
+// using the terms memoized in the state of the environment if they are still valid
+func (h *Helper) Term(env *Env, k float64) float64 {
+	st := env.state()
+	m := st.seqs[h]
+	if m == nil || m.gen != memoGen {
+		m = &seqMemo{gen: memoGen, usesX: h.usesX()}
+		st.seqs[h] = m
+	}
+	if key := m.memoKey(env); m.vals == nil || key != m.key {
+		m.key = key
+		m.vals = map[float64]float64{}
+		m.busy = nil
+	}
+	return h.term(m, env, k)
+}
+
+// term returns the term with the given index, evaluating the earlier terms first if the sequence is recursive
+// so that they are memoized and the recursion does not get deep
+func (h *Helper) term(m *seqMemo, env *Env, k float64) float64 {
+	if v, ok := m.vals[k]; ok {
+		return v
+	}
+	if n := len(m.busy); n > 0 && h.Recursive && k >= m.busy[n-1] {
+		h.Warn(fmt.Errorf("%v(%v) depends on %v(%v); each term can only use earlier terms", h.Name, m.busy[n-1], h.Name, k))
+		return math.NaN()
+	}
+	for _, b := range h.Bases {
+		if b.Index == k {
+			if b.Val == nil {
+				return math.NaN()
+			}
+			return h.eval(m, env, k, b.Val, nil)
+		}
+	}
+	if !h.Recursive {
+		return h.eval(m, env, k, h.Val, []float64{k})
+	}
+	first := math.Inf(1)
+	for _, b := range h.Bases {
+		first = min(first, b.Index)
+	}
+	if k != math.Floor(k) || k < first || k-first > MaxTerms {
+		h.Warn(fmt.Errorf("%v(%v) is not defined; %v is only defined for whole numbers from its first base case %v(%v)", h.Name, k, h.Name, h.Name, first))
+		return math.NaN()
+	}
+	start := k
+	for start > first {
+		if _, ok := m.vals[start-1]; ok {
+			break
+		}
+		start--
+	}
+	for i := start; i < k; i++ {
+		h.term(m, env, i)
+	}
+	return h.eval(m, env, k, h.Val, []float64{k})
+}
+
+// eval evaluates the term with the given index using the given compiled body and arguments, and memoizes it
+func (h *Helper) eval(m *seqMemo, env *Env, k float64, val *Compiled, args []float64) float64 {
+	m.busy = append(m.busy, k)
+	e := *env
+	e.Args = args
+	v := val.Num(&e)
+	m.busy = m.busy[:len(m.busy)-1]
+	m.vals[k] = v
+	return v
+}
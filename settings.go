@@ -24,6 +24,8 @@ type Settings struct {
 	LineFontSize int  `label:"Line Font Size"`
 	ConfirmQuit  bool `label:"Confirm App Close"`
 	PrettyJSON   bool `label:"Save formatted JSON"`
+
+	IntegralSettings IntegralSettings `display:"inline" label:"Integral Settings"`
 }
 
 // MarbleSettings are the settings for the marbles in the app
@@ -129,6 +131,7 @@ func (se *Settings) Defaults() {
 	se.LineFontSize = 24
 	se.ConfirmQuit = true
 	se.PrettyJSON = false
+	se.IntegralSettings.Defaults()
 }
 
 // Defaults sets the default settings for the tracking lines.
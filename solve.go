@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// SolveSteps is the number of pieces that root, argmin and argmax split their interval into
+// to find where a root or extremum is before narrowing it down
+const SolveSteps = 256
+
+// funcRef returns the name of the function that the given argument refers to, like f in root(f, a, b)
+func funcRef(n Node) (string, bool) {
+	fn, ok := unparen(n).(*FuncNode)
+	if !ok {
+		return "", false
+	}
+	return fn.Name, true
+}
+
+// compileFuncsCall compiles a call to a function with [Function.Funcs], like root(f, a, b).
+// When there is no result, it is NaN and the problem is reported with [Context.Warn].
+func compileFuncsCall(n *CallNode, fn *Function, cx *Context) (*Compiled, error) {
+	fs := make([]FuncArg, fn.Funcs)
+	isConst := fn.Pure
+	for i, a := range n.Args[:fn.Funcs] {
+		name, ok := funcRef(a)
+		rf := cx.Functions[name]
+		if !ok || rf == nil || rf.Funcs > 0 || (rf.NArgs != 1 && rf.NArgs != -1) {
+			return nil, compileError(a, "argument %v of %v needs to be the name of a function of one argument, like f", i, n.Name)
+		}
+		if rf.Call1 != nil {
+			fs[i] = rf.Call1
+		} else {
+			call := rf.Call
+			fs[i] = func(env *Env, x float64) float64 { return call(env, []float64{x}) }
+		}
+		isConst = isConst && rf.Pure
+	}
+	args := make([]func(env *Env) float64, len(n.Args)-fn.Funcs)
+	for i, a := range n.Args[fn.Funcs:] {
+		c, err := CompileNode(a, cx)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind != KindNumber {
+			return nil, compileError(a, "function %v needs float64 arguments, not a %v value for argument %v", n.Name, c.Kind, i+fn.Funcs)
+		}
+		args[i] = c.Num
+		isConst = isConst && c.Const
+	}
+	call, warn := fn.CallFuncs, cx.Warn
+	pos, end := n.Pos(), n.End()
+	return &Compiled{Kind: KindNumber, Const: isConst, Num: func(env *Env) float64 {
+		st := env.state()
+		vals, top := st.pushArgs(len(args))
+		for i, arg := range args {
+			vals[i] = arg(env)
+		}
+		v, err := call(env, fs, vals)
+		st.popArgs(top)
+		if err != nil && warn != nil {
+			warn(&SyntaxError{pos, end, err.Error()})
+		}
+		return v
+	}}, nil
+}
+
+// Root returns the first x between args[0] and args[1] where fs[0] is 0
+func Root(env *Env, fs []FuncArg, args []float64) (float64, error) {
+	a, b := args[0], args[1]
+	if err := checkBounds("root", a, b); err != nil {
+		return math.NaN(), err
+	}
+	f := func(x float64) float64 { return fs[0](env, x) }
+	if x, ok := FindRoot(f, min(a, b), max(a, b)); ok {
+		return x, nil
+	}
+	return math.NaN(), fmt.Errorf("root: the function is not 0 anywhere between %v and %v", a, b)
+}
+
+// Intersect returns the x closest to args[0] where fs[0] and fs[1] are equal
+func Intersect(env *Env, fs []FuncArg, args []float64) (float64, error) {
+	x0 := args[0]
+	if math.IsNaN(x0) || math.IsInf(x0, 0) {
+		return math.NaN(), fmt.Errorf("intersect: the starting x needs to be a finite number, not %v", x0)
+	}
+	h := func(x float64) float64 { return fs[0](env, x) - fs[1](env, x) }
+	if x, ok := FindRootNear(h, x0); ok {
+		return x, nil
+	}
+	return math.NaN(), fmt.Errorf("intersect: the functions do not intersect near %v", x0)
+}
+
+// Argmin returns the x between args[0] and args[1] where fs[0] is smallest
+func Argmin(env *Env, fs []FuncArg, args []float64) (float64, error) {
+	return argExtremum("argmin", func(x float64) float64 { return fs[0](env, x) }, args[0], args[1])
+}
+
+// Argmax returns the x between args[0] and args[1] where fs[0] is largest
+func Argmax(env *Env, fs []FuncArg, args []float64) (float64, error) {
+	return argExtremum("argmax", func(x float64) float64 { return -fs[0](env, x) }, args[0], args[1])
+}
+
+// argExtremum returns the x between a and b where f is smallest
+func argExtremum(name string, f func(x float64) float64, a, b float64) (float64, error) {
+	if err := checkBounds(name, a, b); err != nil {
+		return math.NaN(), err
+	}
+	if x, ok := FindMin(f, min(a, b), max(a, b)); ok {
+		return x, nil
+	}
+	return math.NaN(), fmt.Errorf("%v: the function is not defined anywhere between %v and %v", name, a, b)
+}
+
+// checkBounds returns an error if the bounds of the interval of the given function are not finite
+func checkBounds(name string, a, b float64) error {
+	if math.IsNaN(a) || math.IsNaN(b) || math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return fmt.Errorf("%v: the bounds need to be finite numbers, not %v and %v", name, a, b)
+	}
+	return nil
+}
+
+// FindRoot returns the smallest x between a and b where f is 0, and whether there is one.
+// The interval is split into [SolveSteps] pieces, and the first piece where f changes sign
+// and that does not just contain a pole is narrowed down with [Brent].
+func FindRoot(f func(x float64) float64, a, b float64) (float64, bool) {
+	x0, f0 := a, f(a)
+	if f0 == 0 {
+		return a, true
+	}
+	dx := (b - a) / SolveSteps
+	for i := 1; i <= SolveSteps; i++ {
+		x1 := a + float64(i)*dx
+		if i == SolveSteps {
+			x1 = b
+		}
+		f1 := f(x1)
+		if f1 == 0 {
+			return x1, true
+		}
+		if x, ok := bracketRoot(f, x0, x1, f0, f1); ok {
+			return x, true
+		}
+		x0, f0 = x1, f1
+	}
+	return math.NaN(), false
+}
+
+// FindRootNear returns the x closest to x0 where f is 0, and whether there is one,
+// searching outward from x0 in steps that get larger the further away they are
+func FindRootNear(f func(x float64) float64, x0 float64) (float64, bool) {
+	fx0 := f(x0)
+	if fx0 == 0 {
+		return x0, true
+	}
+	scale := max(1, math.Abs(x0))
+	step := scale / 100
+	l, fl, r, fr := x0, fx0, x0, fx0
+	for r-x0 < 1e6*scale {
+		nr, nl := r+step, l-step
+		fnr, fnl := f(nr), f(nl)
+		if x, ok := bracketRoot(f, r, nr, fr, fnr); ok {
+			return x, true
+		}
+		if x, ok := bracketRoot(f, nl, l, fnl, fl); ok {
+			return x, true
+		}
+		l, fl, r, fr = nl, fnl, nr, fnr
+		step *= 1.25
+	}
+	return math.NaN(), false
+}
+
+// bracketRoot returns the root of f between a and b if f changes sign between them
+// and the result is actually a root, instead of a pole like that of tan
+func bracketRoot(f func(x float64) float64, a, b, fa, fb float64) (float64, bool) {
+	if fb == 0 {
+		return b, true
+	}
+	if math.IsNaN(fa) || math.IsNaN(fb) || math.Signbit(fa) == math.Signbit(fb) {
+		return 0, false
+	}
+	x := Brent(f, a, b, fa, fb)
+	if fx := f(x); math.Abs(fx) <= 1e-6*max(1, math.Abs(fa), math.Abs(fb)) {
+		return x, true
+	}
+	return 0, false
+}
+
+// Brent returns the root of f between a and b with Brent's method,
+// given that fa and fb, the values of f at a and b, have different signs
+func Brent(f func(x float64) float64, a, b, fa, fb float64) float64 {
+	if math.Abs(fa) < math.Abs(fb) {
+		a, b, fa, fb = b, a, fb, fa
+	}
+	c, fc := a, fa
+	d := b - a
+	e := d
+	for range 100 {
+		if math.Signbit(fb) == math.Signbit(fc) {
+			c, fc = a, fa
+			d = b - a
+			e = d
+		}
+		if math.Abs(fc) < math.Abs(fb) {
+			a, b, c = b, c, b
+			fa, fb, fc = fb, fc, fb
+		}
+		tol := 2e-16*math.Abs(b) + 1e-300
+		m := (c - b) / 2
+		if math.Abs(m) <= tol || fb == 0 {
+			return b
+		}
+		if math.Abs(e) >= tol && math.Abs(fa) > math.Abs(fb) {
+			// interpolation
+			var p, q float64
+			s := fb / fa
+			if a == c {
+				p = 2 * m * s
+				q = 1 - s
+			} else {
+				q = fa / fc
+				r := fb / fc
+				p = s * (2*m*q*(q-r) - (b-a)*(r-1))
+				q = (q - 1) * (r - 1) * (s - 1)
+			}
+			if p > 0 {
+				q = -q
+			} else {
+				p = -p
+			}
+			if 2*p < min(3*m*q-math.Abs(tol*q), math.Abs(e*q)) {
+				e = d
+				d = p / q
+			} else {
+				d = m
+				e = m
+			}
+		} else {
+			d = m
+			e = m
+		}
+		a, fa = b, fb
+		if math.Abs(d) > tol {
+			b += d
+		} else {
+			b += math.Copysign(tol, m)
+		}
+		fb = f(b)
+	}
+	return b
+}
+
+// FindMin returns the x between a and b where f is smallest, and whether f is defined anywhere there.
+// The interval is split into [SolveSteps] pieces, and the piece around the smallest value is narrowed
+// down with a golden section search.
+func FindMin(f func(x float64) float64, a, b float64) (float64, bool) {
+	dx := (b - a) / SolveSteps
+	best, bestY := math.NaN(), math.Inf(1)
+	for i := 0; i <= SolveSteps; i++ {
+		x := a + float64(i)*dx
+		if i == SolveSteps {
+			x = b
+		}
+		if y := f(x); y < bestY || (math.IsNaN(best) && !math.IsNaN(y)) {
+			best, bestY = x, y
+		}
+	}
+	if math.IsNaN(best) {
+		return math.NaN(), false
+	}
+	lo, hi := max(a, best-dx), min(b, best+dx)
+	if x := goldenSection(f, lo, hi); f(x) < bestY {
+		return x, true
+	}
+	return best, true
+}
+
+// goldenSection returns the x between a and b where f is smallest, assuming that it only has one minimum there
+func goldenSection(f func(x float64) float64, a, b float64) float64 {
+	const invPhi = 0.6180339887498949
+	c, d := b-invPhi*(b-a), a+invPhi*(b-a)
+	fc, fd := f(c), f(d)
+	for range 100 {
+		if b-a <= 1e-12*max(1, math.Abs(a)+math.Abs(b)) {
+			break
+		}
+		if fc < fd {
+			b, d, fd = d, c, fc
+			c = b - invPhi*(b-a)
+			fc = f(c)
+		} else {
+			a, c, fc = c, d, fd
+			d = a + invPhi*(b-a)
+			fd = f(d)
+		}
+	}
+	return (a + b) / 2
+}
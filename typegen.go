@@ -6,6 +6,6 @@ import (
 	"cogentcore.org/core/types"
 )
 
-var _ = types.AddType(&types.Type{Name: "main.Graph", IDName: "graph", Doc: "Graph contains the lines and parameters of a graph", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Methods: []types.Method{{Name: "Graph", Doc: "Graph updates graph for current equations, and resets marbles too", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Run", Doc: "Run runs the marbles for NSteps", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Stop", Doc: "Stop stops the marbles", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Step", Doc: "Step does one step update of marbles", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "StopSelecting", Doc: "StopSelecting stops selecting current marble", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "TrackSelectedMarble", Doc: "TrackSelectedMarble toggles track for the currently selected marble", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "AddLine", Doc: "AddLine adds a new blank line", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Reset", Doc: "Reset resets the graph to its starting position (one default line and default params)", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "SaveLast", Doc: "SaveLast saves to the last opened or saved file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "OpenJSON", Doc: "OpenJSON opens a graph from a JSON file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Args: []string{"filename"}, Returns: []string{"error"}}, {Name: "SaveJSON", Doc: "SaveJSON saves a graph to a JSON file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Args: []string{"filename"}, Returns: []string{"error"}}, {Name: "SelectNextMarble", Doc: "SelectNextMarble selects the next marble in the viewbox", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}}, Fields: []types.Field{{Name: "Params", Doc: "the parameters for updating the marbles"}, {Name: "Lines", Doc: "the lines of the graph -- can have any number"}, {Name: "Marbles"}, {Name: "State"}, {Name: "Functions"}, {Name: "Vectors"}, {Name: "Objects"}, {Name: "EvalMu"}}})
+var _ = types.AddType(&types.Type{Name: "main.Graph", IDName: "graph", Doc: "Graph contains the lines and parameters of a graph", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Methods: []types.Method{{Name: "Graph", Doc: "Graph updates graph for current equations, and resets marbles too", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Run", Doc: "Run runs the marbles for NSteps", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Stop", Doc: "Stop stops the marbles", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Step", Doc: "Step does one step update of marbles", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "StopSelecting", Doc: "StopSelecting stops selecting current marble", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "TrackSelectedMarble", Doc: "TrackSelectedMarble toggles track for the currently selected marble", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "AddLine", Doc: "AddLine adds a new blank line", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "Reset", Doc: "Reset resets the graph to its starting position (one default line and default params)", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "SaveLast", Doc: "SaveLast saves to the last opened or saved file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}, {Name: "OpenJSON", Doc: "OpenJSON opens a graph from a JSON file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Args: []string{"filename"}, Returns: []string{"error"}}, {Name: "SaveJSON", Doc: "SaveJSON saves a graph to a JSON file", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Args: []string{"filename"}, Returns: []string{"error"}}, {Name: "SelectNextMarble", Doc: "SelectNextMarble selects the next marble in the viewbox", Directives: []types.Directive{{Tool: "types", Directive: "add"}}}}, Fields: []types.Field{{Name: "Params", Doc: "the parameters for updating the marbles"}, {Name: "Lines", Doc: "the lines of the graph -- can have any number"}, {Name: "Variables", Doc: "the named variables of the graph, which can be used in every expression"}, {Name: "Helpers", Doc: "the helper functions of the graph, which can have any number of parameters and be used in every expression"}, {Name: "Marbles"}, {Name: "State"}, {Name: "Functions"}, {Name: "Vectors"}, {Name: "Objects"}, {Name: "EvalMu"}}})
 
-var _ = types.AddType(&types.Type{Name: "main.Params", IDName: "params", Doc: "Params are the parameters of the graph", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Fields: []types.Field{{Name: "NMarbles", Doc: "Number of marbles"}, {Name: "MarbleStartX", Doc: "Marble horizontal start position"}, {Name: "MarbleStartY", Doc: "Marble vertical start position"}, {Name: "StartVelocityY", Doc: "Starting horizontal velocity of the marbles"}, {Name: "StartVelocityX", Doc: "Starting vertical velocity of the marbles"}, {Name: "UpdateRate", Doc: "how fast to move along velocity vector -- lower = smoother, more slow-mo"}, {Name: "TimeStep", Doc: "how fast time increases"}, {Name: "YForce", Doc: "how fast it accelerates down"}, {Name: "XForce", Doc: "how fast the marbles move side to side without collisions, set to 0 for no movement"}, {Name: "CenterX", Doc: "the center point of the graph, x"}, {Name: "CenterY", Doc: "the center point of the graph, y"}, {Name: "TrackingSettings"}}})
+var _ = types.AddType(&types.Type{Name: "main.Params", IDName: "params", Doc: "Params are the parameters of the graph", Directives: []types.Directive{{Tool: "types", Directive: "add"}}, Fields: []types.Field{{Name: "NMarbles", Doc: "Number of marbles"}, {Name: "MarbleStartX", Doc: "Marble horizontal start position"}, {Name: "MarbleStartY", Doc: "Marble vertical start position"}, {Name: "MarbleStart", Doc: "Marble start position as a point, like (10(rand-0.5), 10-2n/nmarbles).\nIf it is set, it is used instead of MarbleStartX and MarbleStartY."}, {Name: "StartVelocityY", Doc: "Starting horizontal velocity of the marbles"}, {Name: "StartVelocityX", Doc: "Starting vertical velocity of the marbles"}, {Name: "UpdateRate", Doc: "how fast to move along velocity vector -- lower = smoother, more slow-mo"}, {Name: "TimeStep", Doc: "how fast time increases"}, {Name: "YForce", Doc: "how fast it accelerates down"}, {Name: "XForce", Doc: "how fast the marbles move side to side without collisions, set to 0 for no movement.\nThe forces can use the [MarbleVars], like -0.01vx for drag."}, {Name: "Force", Doc: "force on the marbles as a vector, like (0, -0.1), which can depend on their position x and y.\nIf it is set, it is used instead of XForce and YForce."}, {Name: "CenterX", Doc: "the center point of the graph, x"}, {Name: "CenterY", Doc: "the center point of the graph, y"}, {Name: "Seed", Doc: "Random seed: runs with the same seed give the same random values, and each marble has its own random values"}, {Name: "TrackingSettings"}}})
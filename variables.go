@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Variable is a named value that can be used in every expression of the graph
+type Variable struct {
+
+	// Name of the variable, like k or w
+	Name string `width:"10"`
+
+	// Value of the variable, like 3 or 2sin(t). It can use x, t, other variables and line functions,
+	// and it is evaluated wherever the variable is used.
+	Expr Expr
+
+	// the minimum value of the slider -- set Max above Min to show a slider for a constant variable
+	Min float64
+
+	// the maximum value of the slider
+	Max float64
+
+	// the step size of the slider
+	Step float64 `min:"0"`
+
+	// whether to animate the value of the slider
+	Play bool
+
+	// whether to loop back to Min after reaching Max when playing, instead of bouncing back and forth
+	Loop bool
+
+	// how fast the value changes when playing, in units per second
+	Rate float64
+
+	// the direction the value is moving in when bouncing back and forth, 1 or -1
+	playDir float64
+}
+
+// Variables is a collection of variables
+type Variables []*Variable
+
+// Find returns the variable with the given name, or nil if there is none
+func (vs Variables) Find(name string) *Variable {
+	for _, v := range vs {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// Context returns the context that expressions in the graph are compiled in
+func (gr *Graph) Context() *Context {
+	return &Context{Functions: gr.Functions, Variables: gr.Variables, Lines: gr.Lines}
+}
+
+// ParseVariables checks the names of the graph variables and parses the ones with valid names.
+// It returns the first error, after reporting the errors of all of the variables.
+func (gr *Graph) ParseVariables() error {
+	var first error
+	for i, v := range gr.Variables {
+		err := gr.CheckVariableName(v.Name, i)
+		if err != nil {
+			v.Expr.Val, v.Expr.Node, v.Expr.Diags = nil, nil, nil
+			v.Expr.Report(err)
+		} else {
+			err = v.Expr.Parse()
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// CompileVariables compiles the parsed graph variables in order, so that each variable
+// is compiled after the variables it uses. It returns the first error.
+func (gr *Graph) CompileVariables() error {
+	order, err := gr.VariableOrder()
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, v := range order {
+		if err := v.Expr.CompileParsed(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// VariableOrder returns the graph variables sorted so that each variable comes after
+// the variables it uses, or an error if there are circular definitions. It uses the
+// syntax trees from [Graph.ParseVariables], so the variables need to be parsed first.
+func (gr *Graph) VariableOrder() (Variables, error) {
+	deps := map[string][]string{}
+	for _, v := range gr.Variables {
+		if v.Expr.Node != nil {
+			deps[v.Name] = gr.Variables.Uses(v.Expr.Node)
+		}
+	}
+	order := []string{}
+	state := map[string]int{} // 1 = visiting, 2 = done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			i := slices.Index(path, name)
+			return fmt.Errorf("circular variable definitions: %v", strings.Join(append(path[i:], name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, d := range deps[name] {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, v := range gr.Variables {
+		if err := visit(v.Name, nil); err != nil {
+			v.Expr.Diags = nil
+			v.Expr.Report(err)
+			return nil, err
+		}
+	}
+	vs := make(Variables, len(order))
+	for i, name := range order {
+		vs[i] = gr.Variables.Find(name)
+	}
+	return vs, nil
+}
+
+// CheckVariableName returns an error if the given name can not be used for the variable with the given index
+func (gr *Graph) CheckVariableName(name string, idx int) error {
+	if name == "" {
+		return fmt.Errorf("variable %v needs a name", idx)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) {
+			return fmt.Errorf("variable name %q can only contain letters", name)
+		}
+	}
+	if IsBuiltinName(name) {
+		return fmt.Errorf("variable name %q is already a built-in name", name)
+	}
+	if _, ok := gr.Functions[name]; ok {
+		return fmt.Errorf("variable name %q is already the name of a function", name)
+	}
+	for i, v := range gr.Variables {
+		if i != idx && v.Name == name {
+			return fmt.Errorf("there are multiple variables named %q", name)
+		}
+	}
+	return nil
+}
+
+// Uses returns the names of the variables that the given syntax tree uses
+func (vs Variables) Uses(n Node) []string {
+	names := []string{}
+	Walk(n, func(n Node) bool {
+		if vn, ok := n.(*VarNode); ok && vs.Find(vn.Name) != nil && !slices.Contains(names, vn.Name) {
+			names = append(names, vn.Name)
+		}
+		return true
+	})
+	return names
+}
+
+// IsSlider returns whether the variable is shown as a slider, which is the case
+// when it has a range and a constant value.
+func (v *Variable) IsSlider() bool {
+	return v.Max > v.Min && v.Expr.Val != nil && v.Expr.Val.Const && v.Expr.Val.Kind == KindNumber
+}
+
+// Value returns the current value of a slider variable
+func (v *Variable) Value() float64 {
+	if v.Expr.Val == nil || v.Expr.Val.Kind != KindNumber {
+		return 0
+	}
+	return v.Expr.Val.Num(&Env{})
+}
+
+// SetValue sets the value of a slider variable, rounded to its step and clamped to its range
+func (v *Variable) SetValue(val float64) {
+	if v.Step > 0 {
+		val = v.Min + math.Round((val-v.Min)/v.Step)*v.Step
+	}
+	val = math.Max(v.Min, math.Min(v.Max, val))
+	s := strconv.FormatFloat(val, 'f', 10, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	v.Expr.Expr = s
+}
+
+// Playing returns whether the variable is a slider whose value is animated
+func (v *Variable) Playing() bool {
+	return v.Play && v.Rate != 0 && v.IsSlider()
+}
+
+// Animate moves the value of a playing slider variable forward by the given number of seconds,
+// and returns whether it changed.
+func (v *Variable) Animate(dt float64) bool {
+	if !v.Playing() {
+		return false
+	}
+	if v.playDir == 0 {
+		v.playDir = 1
+	}
+	val := v.Value() + v.playDir*v.Rate*dt
+	size := v.Max - v.Min
+	switch {
+	case v.Loop:
+		val = v.Min + math.Mod(math.Mod(val-v.Min, size)+size, size)
+	case val > v.Max:
+		val = v.Max - (val - v.Max)
+		v.playDir = -v.playDir
+	case val < v.Min:
+		val = v.Min + (v.Min - val)
+		v.playDir = -v.playDir
+	}
+	step := v.Step
+	v.Step = 0 // animate smoothly instead of in steps
+	v.SetValue(val)
+	v.Step = step
+	return true
+}
+
+// UpdateVariable recompiles the given variable after its value changed, along with only
+// the variables, lines and params that use it, and redraws the graph without resetting the marbles.
+func (gr *Graph) UpdateVariable(v *Variable) {
+	gr.EvalMu.Lock()
+	defer gr.EvalMu.Unlock()
+
+	order, err := gr.VariableOrder()
+	if err != nil {
+		return
+	}
+	changed := Variables{v}
+	for _, ov := range order {
+		if ov == v {
+			ov.Expr.Compile()
+			continue
+		}
+		if ov.Expr.Node != nil && changed.UsesAny(ov.Expr.Node) {
+			changed = append(changed, ov)
+			ov.Expr.Compile()
+		}
+	}
+	changedHelpers := []string{}
+	for _, h := range gr.Helpers {
+		if changed.UsesAny(h.Node) {
+			changedHelpers = append(changedHelpers, h.Name)
+			h.Diags = nil
+			h.Compile()
+		}
+	}
+	for _, ln := range gr.Lines {
+		// the lines without a syntax tree have errors that a new value does not fix, like circular definitions
+		if ln.Expr.Node == nil {
+			continue
+		}
+		// the derivatives of the line include the bodies of the helpers it calls
+		callsChanged := slices.ContainsFunc(gr.Calls(ln.Expr.Node), func(c string) bool {
+			return slices.Contains(changedHelpers, c)
+		})
+		if callsChanged || changed.UsesAny(ln.Expr.Node) || changed.UsesAny(ln.GraphIf.Node) || changed.UsesAny(ln.Bounce.Node) {
+			ln.Compile()
+		}
+	}
+	if slices.ContainsFunc([]*Expr{&gr.Params.MarbleStartX, &gr.Params.MarbleStartY, &gr.Params.MarbleStart}, func(ex *Expr) bool {
+		return changed.UsesAny(ex.Node)
+	}) {
+		gr.Params.CompileStart()
+	}
+	for _, pr := range gr.Params.ParamList() {
+		if changed.UsesAny(pr.Expr.Node) {
+			pr.Compile()
+		}
+	}
+	if changed.UsesAny(gr.Params.Force.Expr.Node) {
+		gr.Params.Force.CompileKind(KindPoint)
+	}
+	if !gr.State.Running.Load() {
+		gr.Objects.Graph.NeedsRender()
+	}
+}
+
+// UsesAny returns whether the given syntax tree uses any of the variables
+func (vs Variables) UsesAny(n Node) bool {
+	if n == nil {
+		return false
+	}
+	return len(vs.Uses(n)) > 0
+}
+
+// AnimateVariables moves all of the playing slider variables forward by the given number of seconds,
+// and returns whether any of them changed.
+func (gr *Graph) AnimateVariables(dt float64) bool {
+	changed := false
+	for _, v := range gr.Variables {
+		if v.Animate(dt) {
+			gr.UpdateVariable(v)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// PlayVariables starts animating the playing slider variables by the time that has passed on the clock,
+// whether or not the marbles are running, until none of them are playing. It does nothing if none of them
+// are playing or they are already being animated.
+func (gr *Graph) PlayVariables() {
+	if !slices.ContainsFunc(gr.Variables, (*Variable).Playing) || !gr.State.Playing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second / 60)
+		defer ticker.Stop()
+		last := time.Now()
+		for now := range ticker.C {
+			dt := now.Sub(last).Seconds()
+			last = now
+			gr.Objects.Graph.AsyncLock()
+			// it stops while holding the lock, so that a slider that starts playing after it checks starts it again
+			if !slices.ContainsFunc(gr.Variables, (*Variable).Playing) {
+				gr.State.Playing.Store(false)
+				gr.Objects.Graph.AsyncUnlock()
+				return
+			}
+			if gr.AnimateVariables(dt) {
+				gr.Objects.SlidersFrame.Update()
+			}
+			gr.Objects.Graph.AsyncUnlock()
+		}
+	}()
+}